@@ -0,0 +1,105 @@
+package main
+
+import (
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per-service proxy options, read from the Service annotations
+const (
+	annotationBalance        = annotationPrefix + "balance"
+	annotationCheckPath      = annotationPrefix + "health-check-path"
+	annotationCheckInterval  = annotationPrefix + "health-check-interval"
+	annotationTimeoutConnect = annotationPrefix + "timeout-connect"
+	annotationTimeoutClient  = annotationPrefix + "timeout-client"
+	annotationTimeoutServer  = annotationPrefix + "timeout-server"
+	annotationMaxConn        = annotationPrefix + "maxconn"
+	annotationProxyProtocol  = annotationPrefix + "proxy-protocol"
+	annotationSticky         = annotationPrefix + "sticky"
+	annotationTemplate       = annotationPrefix + "template"
+)
+
+type ServiceOptions struct {
+	Balance        string
+	CheckPath      string
+	CheckInterval  time.Duration
+	TimeoutConnect time.Duration
+	TimeoutClient  time.Duration
+	TimeoutServer  time.Duration
+	MaxConn        int
+	ProxyProtocol  bool
+	Sticky         bool
+	Template       string
+}
+
+var defaultServiceOptions = ServiceOptions{
+	Balance:       "roundrobin",
+	CheckInterval: 1 * time.Second,
+}
+
+// getServiceOptions parses the options annotations of a Service, invalid
+// values are logged and left to their default. It also returns all the
+// annotations of the namespace, with the prefix stripped, for templates.
+func getServiceOptions(s *corev1.Service) (ServiceOptions, map[string]string) {
+
+	opts := defaultServiceOptions
+	annotations := make(map[string]string)
+	name := cacheKey(s.GetMetadata().GetNamespace(), s.GetMetadata().GetName())
+
+	parseDuration := func(key string, value string, d *time.Duration) {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			log.Warnf("Service %v: invalid duration for %v: %v", name, key, err)
+			return
+		}
+		*d = v
+	}
+
+	parseBool := func(key string, value string, b *bool) {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Warnf("Service %v: invalid boolean for %v: %v", name, key, err)
+			return
+		}
+		*b = v
+	}
+
+	for k, v := range s.GetMetadata().GetAnnotations() {
+		if !strings.HasPrefix(k, annotationPrefix) {
+			continue
+		}
+		annotations[strings.TrimPrefix(k, annotationPrefix)] = v
+
+		switch k {
+		case annotationBalance:
+			opts.Balance = v
+		case annotationCheckPath:
+			opts.CheckPath = v
+		case annotationCheckInterval:
+			parseDuration(k, v, &opts.CheckInterval)
+		case annotationTimeoutConnect:
+			parseDuration(k, v, &opts.TimeoutConnect)
+		case annotationTimeoutClient:
+			parseDuration(k, v, &opts.TimeoutClient)
+		case annotationTimeoutServer:
+			parseDuration(k, v, &opts.TimeoutServer)
+		case annotationMaxConn:
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Warnf("Service %v: invalid value for %v: %q", name, k, v)
+				continue
+			}
+			opts.MaxConn = n
+		case annotationProxyProtocol:
+			parseBool(k, v, &opts.ProxyProtocol)
+		case annotationSticky:
+			parseBool(k, v, &opts.Sticky)
+		case annotationTemplate:
+			opts.Template = v
+		}
+	}
+
+	return opts, annotations
+}
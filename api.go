@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("api-server returned %v: %v", e.Code, e.Message)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func isConflict(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Code == http.StatusConflict
+}
+
+// apiDo sends a raw JSON request to the api-server, for the calls the k8s
+// client does not cover (patches, subresources, newer API groups). The
+// caller must close the response body.
+func apiDo(ctx context.Context, client *k8s.Client, method string, path string, contentType string, body interface{}) (*http.Response, error) {
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot encode request: %v", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, client.Endpoint+path, r)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if client.SetHeaders != nil {
+		if err := client.SetHeaders(req.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &apiError{Code: resp.StatusCode, Message: string(msg)}
+	}
+
+	return resp, nil
+}
+
+// apiRequest sends a raw JSON request and decodes the response into out
+func apiRequest(ctx context.Context, client *k8s.Client, method string, path string, contentType string, body interface{}, out interface{}) error {
+
+	resp, err := apiDo(ctx, client, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("Cannot decode response: %v", err)
+		}
+	}
+
+	return nil
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// apiWatch streams the watch events of path to handle, until the stream
+// drops, handle fails or ctx is cancelled
+func apiWatch(ctx context.Context, client *k8s.Client, path string, handle func(event string, object json.RawMessage) error) error {
+
+	resp, err := apiDo(ctx, client, "GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+
+		if ev.Type == k8s.EventError {
+			return fmt.Errorf("watch error: %s", ev.Object)
+		}
+
+		if err := handle(ev.Type, ev.Object); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenRefresh      = 1 * time.Minute
+	tokenExpiryMargin = 30 * time.Second
+)
+
+// kubeconfig user fields the k8s client does not handle
+type execEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type execConfig struct {
+	APIVersion string       `json:"apiVersion"`
+	Command    string       `json:"command"`
+	Args       []string     `json:"args"`
+	Env        []execEnvVar `json:"env"`
+}
+
+type kubeconfigUser struct {
+	TokenFile string      `json:"tokenFile"`
+	Exec      *execConfig `json:"exec"`
+}
+
+type kubeconfigUsers struct {
+	Users []struct {
+		Name string         `json:"name"`
+		User kubeconfigUser `json:"user"`
+	} `json:"users"`
+}
+
+type execCredential struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Interactive bool `json:"interactive"`
+	} `json:"spec"`
+	Status *struct {
+		Token               string     `json:"token"`
+		ExpirationTimestamp *time.Time `json:"expirationTimestamp"`
+	} `json:"status,omitempty"`
+}
+
+// tokenSource returns a bearer token, fetched again once expired
+type tokenSource struct {
+	sync.Mutex
+	fetch   func() (string, time.Time, error)
+	token   string
+	expires time.Time
+}
+
+func (s *tokenSource) get() (string, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.token != "" && (s.expires.IsZero() || time.Now().Before(s.expires)) {
+		return s.token, nil
+	}
+
+	token, expires, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expires = token, expires
+
+	return token, nil
+}
+
+func (s *tokenSource) setHeaders(h http.Header) error {
+
+	token, err := s.get()
+	if err != nil {
+		return fmt.Errorf("Cannot get token: %v", err)
+	}
+
+	h.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// fileTokenSource reads the token from a file, read again every minute so
+// rotated tokens are picked up without a restart
+func fileTokenSource(path string) *tokenSource {
+	return &tokenSource{
+		fetch: func() (string, time.Time, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return strings.TrimSpace(string(data)), time.Now().Add(tokenRefresh), nil
+		},
+	}
+}
+
+// execTokenSource runs a client-go credential plugin, the token is cached
+// until the expiration it reports
+func execTokenSource(cfg *execConfig) *tokenSource {
+	return &tokenSource{
+		fetch: func() (string, time.Time, error) {
+
+			var req execCredential
+			req.APIVersion = cfg.APIVersion
+			req.Kind = "ExecCredential"
+			info, err := json.Marshal(&req)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+
+			cmd := exec.Command(cfg.Command, cfg.Args...)
+			cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+			for _, env := range cfg.Env {
+				cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+			}
+			cmd.Stderr = os.Stderr
+
+			out, err := cmd.Output()
+			if err != nil {
+				return "", time.Time{}, fmt.Errorf("exec plugin %v failed: %v", cfg.Command, err)
+			}
+
+			var cred execCredential
+			if err := json.Unmarshal(out, &cred); err != nil {
+				return "", time.Time{}, fmt.Errorf("exec plugin %v: cannot decode credential: %v", cfg.Command, err)
+			}
+			if cred.Status == nil || cred.Status.Token == "" {
+				return "", time.Time{}, fmt.Errorf("exec plugin %v returned no token", cfg.Command)
+			}
+
+			var expires time.Time
+			if cred.Status.ExpirationTimestamp != nil {
+				expires = cred.Status.ExpirationTimestamp.Add(-tokenExpiryMargin)
+			}
+
+			return cred.Status.Token, expires, nil
+		},
+	}
+}
+
+// resolvePath makes paths of a kubeconfig relative to its directory
+func resolvePath(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func inCluster() bool {
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != ""
+}
+
+// loadInClusterClient uses the service account mounted in the pod
+func loadInClusterClient() (*k8s.Client, error) {
+
+	server := "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	namespace, _ := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+
+	cfg := k8s.Config{
+		Clusters: []k8s.NamedCluster{{
+			Name: "in-cluster",
+			Cluster: k8s.Cluster{
+				Server:               server,
+				CertificateAuthority: filepath.Join(serviceAccountDir, "ca.crt"),
+			},
+		}},
+		AuthInfos: []k8s.NamedAuthInfo{{Name: "in-cluster"}},
+		Contexts: []k8s.NamedContext{{
+			Name: "in-cluster",
+			Context: k8s.Context{
+				Cluster:   "in-cluster",
+				AuthInfo:  "in-cluster",
+				Namespace: strings.TrimSpace(string(namespace)),
+			},
+		}},
+		CurrentContext: "in-cluster",
+	}
+
+	client, err := k8s.NewClient(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	src := fileTokenSource(filepath.Join(serviceAccountDir, "token"))
+	if _, err := src.get(); err != nil {
+		return nil, fmt.Errorf("read service account token: %v", err)
+	}
+	client.SetHeaders = src.setHeaders
+
+	return client, nil
+}
+
+// loadClient reads the kubeconfig file, using context if set instead of the
+// current one. Without kubeconfig file, the in-cluster service account is
+// used when running in a pod.
+func loadClient(kubeconfigPath string, context string) (*k8s.Client, error) {
+
+	data, err := ioutil.ReadFile(kubeconfigPath)
+	if os.IsNotExist(err) && inCluster() && context == "" {
+		log.Infof("No kubeconfig at %v, using in-cluster config", kubeconfigPath)
+		return loadInClusterClient()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig: %v", err)
+	}
+
+	var cfg k8s.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal kubeconfig: %v", err)
+	}
+
+	var users kubeconfigUsers
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("unmarshal kubeconfig: %v", err)
+	}
+
+	if context != "" {
+		cfg.CurrentContext = context
+	}
+
+	var userName string
+	found := false
+	for _, c := range cfg.Contexts {
+		if c.Name == cfg.CurrentContext {
+			userName = c.Context.AuthInfo
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig", cfg.CurrentContext)
+	}
+
+	client, err := k8s.NewClient(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(kubeconfigPath)
+	for _, u := range users.Users {
+		if u.Name != userName {
+			continue
+		}
+
+		switch {
+		case u.User.Exec != nil:
+			execCfg := *u.User.Exec
+			if strings.Contains(execCfg.Command, "/") {
+				execCfg.Command = resolvePath(dir, execCfg.Command)
+			}
+			client.SetHeaders = execTokenSource(&execCfg).setHeaders
+		case u.User.TokenFile != "":
+			client.SetHeaders = fileTokenSource(resolvePath(dir, u.User.TokenFile)).setHeaders
+		}
+	}
+
+	return client, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Backend applies the services to a load balancer implementation. Apply is
+// called from the sync loop with the full list of services each time it
+// changes.
+type Backend interface {
+	Apply(ctx context.Context, services []Service) error
+}
+
+type backendFactory func() (Backend, error)
+
+var backends = make(map[string]backendFactory)
+
+// registerBackend makes a backend available to the -backend flag, backends
+// register themselves from an init function
+func registerBackend(name string, factory backendFactory) {
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("backend %v registered twice", name))
+	}
+	backends[name] = factory
+}
+
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newBackend(name string) (Backend, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, available: %v", name, strings.Join(backendNames(), ", "))
+	}
+	return factory()
+}
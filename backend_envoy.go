@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tcpproxyv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoveryservice "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envoyNodeID         = "k8s-external-lb"
+	envoyConnectTimeout = 5 * time.Second
+)
+
+// envoyNodeHash serves the same snapshot to every Envoy node
+type envoyNodeHash struct{}
+
+func (envoyNodeHash) ID(node *corev3.Node) string {
+	return envoyNodeID
+}
+
+// envoyBackend is an xDS control-plane: each service becomes a listener on
+// LoadBalancerIP:Port proxying to a cluster, whose endpoints are sent over
+// EDS with their health and zone. Every Apply pushes a new versioned
+// snapshot, Envoy then fetches only what changed.
+type envoyBackend struct {
+	cache   cachev3.SnapshotCache
+	version uint64
+}
+
+func init() {
+	registerBackend("envoy", func() (Backend, error) {
+		return newEnvoyBackend(context.Background(), config.envoyListen)
+	})
+}
+
+func newEnvoyBackend(ctx context.Context, listen string) (*envoyBackend, error) {
+
+	b := &envoyBackend{
+		cache: cachev3.NewSnapshotCache(false, envoyNodeHash{}, log),
+	}
+
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot listen for xDS on %v: %v", listen, err)
+	}
+
+	srv := serverv3.NewServer(ctx, b.cache, nil)
+	g := grpc.NewServer()
+	discoveryservice.RegisterAggregatedDiscoveryServiceServer(g, srv)
+	listenerservice.RegisterListenerDiscoveryServiceServer(g, srv)
+	clusterservice.RegisterClusterDiscoveryServiceServer(g, srv)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(g, srv)
+
+	go func() {
+		log.Infof("Serving xDS on %v", listen)
+		log.Fatalf("xDS server failed: %v", g.Serve(lis))
+	}()
+
+	return b, nil
+}
+
+func envoyAddress(ip string, port int32, protocol corev3.SocketAddress_Protocol) *corev3.Address {
+	return &corev3.Address{
+		Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{
+				Protocol: protocol,
+				Address:  ip,
+				PortSpecifier: &corev3.SocketAddress_PortValue{
+					PortValue: uint32(port),
+				},
+			},
+		},
+	}
+}
+
+func envoyListener(service Service) (*listenerv3.Listener, error) {
+
+	proxy, err := anypb.New(&tcpproxyv3.TcpProxy{
+		StatPrefix: service.Name,
+		ClusterSpecifier: &tcpproxyv3.TcpProxy_Cluster{
+			Cluster: service.Name,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &listenerv3.Listener{
+		Name:    service.Name,
+		Address: envoyAddress(service.LoadBalancerIP, service.Port, corev3.SocketAddress_TCP),
+		FilterChains: []*listenerv3.FilterChain{{
+			Filters: []*listenerv3.Filter{{
+				Name: wellknown.TCPProxy,
+				ConfigType: &listenerv3.Filter_TypedConfig{
+					TypedConfig: proxy,
+				},
+			}},
+		}},
+	}, nil
+}
+
+func envoyCluster(service Service) *clusterv3.Cluster {
+
+	timeout := service.Options.TimeoutConnect
+	if timeout == 0 {
+		timeout = envoyConnectTimeout
+	}
+
+	lbPolicy := clusterv3.Cluster_ROUND_ROBIN
+	if service.Options.Balance == "leastconn" {
+		lbPolicy = clusterv3.Cluster_LEAST_REQUEST
+	}
+
+	return &clusterv3.Cluster{
+		Name:                 service.Name,
+		ConnectTimeout:       durationpb.New(timeout),
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		LbPolicy:             lbPolicy,
+		EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+			EdsConfig: &corev3.ConfigSource{
+				ResourceApiVersion: corev3.ApiVersion_V3,
+				ConfigSourceSpecifier: &corev3.ConfigSource_Ads{
+					Ads: &corev3.AggregatedConfigSource{},
+				},
+			},
+		},
+	}
+}
+
+// envoyEndpoints groups the endpoints by zone, terminating ones are draining
+func envoyEndpoints(service Service) *endpointv3.ClusterLoadAssignment {
+
+	zones := make(map[string]*endpointv3.LocalityLbEndpoints)
+	var names []string
+
+	for _, ep := range service.Backends {
+		locality, ok := zones[ep.Zone]
+		if !ok {
+			locality = &endpointv3.LocalityLbEndpoints{
+				Locality: &corev3.Locality{Zone: ep.Zone},
+			}
+			zones[ep.Zone] = locality
+			names = append(names, ep.Zone)
+		}
+
+		health := corev3.HealthStatus_HEALTHY
+		if ep.Terminating {
+			health = corev3.HealthStatus_DRAINING
+		} else if !ep.Ready {
+			health = corev3.HealthStatus_UNHEALTHY
+		}
+
+		locality.LbEndpoints = append(locality.LbEndpoints, &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+				Endpoint: &endpointv3.Endpoint{
+					Address:  envoyAddress(ep.IP, ep.Port, corev3.SocketAddress_TCP),
+					Hostname: ep.TargetRef.Name,
+				},
+			},
+			HealthStatus: health,
+		})
+	}
+
+	sort.Strings(names)
+
+	cla := &endpointv3.ClusterLoadAssignment{ClusterName: service.Name}
+	for _, name := range names {
+		cla.Endpoints = append(cla.Endpoints, zones[name])
+	}
+
+	return cla
+}
+
+func (b *envoyBackend) Apply(ctx context.Context, services []Service) error {
+
+	var listeners, clusters, endpoints []types.Resource
+
+	for _, service := range services {
+		if !strings.EqualFold(service.Protocol, "TCP") {
+			log.Warnf("Envoy: service %v skipped, protocol %v not supported", service.Name, service.Protocol)
+			continue
+		}
+
+		listener, err := envoyListener(service)
+		if err != nil {
+			return fmt.Errorf("Cannot build listener %v: %v", service.Name, err)
+		}
+
+		listeners = append(listeners, listener)
+		clusters = append(clusters, envoyCluster(service))
+		endpoints = append(endpoints, envoyEndpoints(service))
+	}
+
+	b.version++
+	snapshot, err := cachev3.NewSnapshot(strconv.FormatUint(b.version, 10), map[resourcev3.Type][]types.Resource{
+		resourcev3.ListenerType: listeners,
+		resourcev3.ClusterType:  clusters,
+		resourcev3.EndpointType: endpoints,
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot build snapshot: %v", err)
+	}
+
+	if err := snapshot.Consistent(); err != nil {
+		return fmt.Errorf("Inconsistent snapshot: %v", err)
+	}
+
+	if err := b.cache.SetSnapshot(ctx, envoyNodeID, snapshot); err != nil {
+		return fmt.Errorf("Cannot set snapshot: %v", err)
+	}
+
+	log.Infof("Envoy snapshot %v pushed: %v listeners", b.version, len(listeners))
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const haproxyTimeout = 5 * time.Second
+
+// haproxySlot is a server line of a backend, free when Endpoint is nil
+type haproxySlot struct {
+	Name     string
+	Endpoint *Endpoint
+}
+
+// haproxyBackend keeps a fixed number of server slots per HAProxy backend.
+// Endpoint changes are pushed through the Runtime API, setting address, port
+// and state of the slots, so HAProxy is only reloaded (through the template
+// backend) when frontends or backends change or when a backend runs out of
+// slots.
+type haproxyBackend struct {
+	tmpl     *templateOutput
+	socket   string
+	minSlots int
+	shape    []Service
+	slots    map[string][]haproxySlot
+	stamp    string
+}
+
+func init() {
+	registerBackend("haproxy", func() (Backend, error) {
+		if config.haproxySlots < 1 {
+			return nil, fmt.Errorf("haproxySlots must be at least 1")
+		}
+		return &haproxyBackend{
+			tmpl:     newTemplateOutput(config.tmplFile, config.configFile, config.reloadScript, config.checkCommand),
+			socket:   config.haproxySocket,
+			minSlots: config.haproxySlots,
+		}, nil
+	})
+}
+
+// servicesShape strips the services from what can be changed at runtime
+func servicesShape(services []Service) []Service {
+	shape := make([]Service, len(services))
+	for i, service := range services {
+		service.Endpoints = nil
+		service.Backends = nil
+		service.TargetPort = 0
+		shape[i] = service
+	}
+	return shape
+}
+
+// newSlots lays out the endpoints on a number of slots doubled from minSlots
+// until they all fit
+func newSlots(endpoints []Endpoint, minSlots int) []haproxySlot {
+
+	n := minSlots
+	for n < len(endpoints) {
+		n *= 2
+	}
+
+	slots := make([]haproxySlot, n)
+	for i := range slots {
+		slots[i].Name = fmt.Sprintf("srv%v", i+1)
+		if i < len(endpoints) {
+			ep := endpoints[i]
+			slots[i].Endpoint = &ep
+		}
+	}
+
+	return slots
+}
+
+func (b *haproxyBackend) Apply(ctx context.Context, services []Service) error {
+
+	shape := servicesShape(services)
+
+	// sub-templates changes are only applied by a reload
+	_, stamp, err := subTemplates.load(config.templatesDir)
+	if err != nil {
+		return err
+	}
+
+	conf := make(map[string]interface{})
+	conf["services"] = services
+
+	if b.slots != nil && stamp == b.stamp && reflect.DeepEqual(shape, b.shape) {
+		err := b.updateServers(services)
+		if err == nil {
+			// keep the file in line with the runtime state for reloads and
+			// restarts not done by us
+			conf["slots"] = b.slots
+			if err := b.tmpl.save(conf); err != nil {
+				log.Errorf("Failed to write config file after runtime update: %v", err)
+			}
+			return nil
+		}
+		log.Warnf("HAProxy runtime update failed, reloading instead: %v", err)
+	}
+
+	slots := make(map[string][]haproxySlot)
+	for _, service := range services {
+		slots[service.Name] = newSlots(activeEndpoints(service.Backends), b.minSlots)
+	}
+	conf["slots"] = slots
+
+	b.shape, b.slots = nil, nil
+	if err := b.tmpl.render(ctx, conf); err != nil {
+		return err
+	}
+	b.shape, b.slots, b.stamp = shape, slots, stamp
+
+	return nil
+}
+
+// updateServers moves the slots of every backend to the new endpoints.
+// Endpoints already in a slot keep it, so their connections are left alone.
+func (b *haproxyBackend) updateServers(services []Service) error {
+
+	for _, service := range services {
+		endpoints := activeEndpoints(service.Backends)
+		current := b.slots[service.Name]
+		if len(endpoints) > len(current) {
+			return fmt.Errorf("backend %v needs %v slots, has %v", service.Name, len(endpoints), len(current))
+		}
+
+		wanted := make(map[string]Endpoint)
+		for _, ep := range endpoints {
+			wanted[ep.String()] = ep
+		}
+
+		slots := make([]haproxySlot, len(current))
+		for i, slot := range current {
+			slots[i].Name = slot.Name
+			if slot.Endpoint == nil {
+				continue
+			}
+			if ep, ok := wanted[slot.Endpoint.String()]; ok {
+				slots[i].Endpoint = &ep
+				delete(wanted, ep.String())
+			}
+		}
+
+		for _, ep := range endpoints {
+			if _, ok := wanted[ep.String()]; !ok {
+				continue
+			}
+			for i := range slots {
+				if slots[i].Endpoint == nil {
+					ep := ep
+					slots[i].Endpoint = &ep
+					break
+				}
+			}
+		}
+
+		for i, slot := range slots {
+			err := b.updateServer(service.Name, current[i], slot)
+			if err != nil {
+				return err
+			}
+		}
+
+		b.slots[service.Name] = slots
+	}
+
+	return nil
+}
+
+func (b *haproxyBackend) updateServer(backend string, from haproxySlot, to haproxySlot) error {
+
+	server := backend + "/" + to.Name
+
+	switch {
+	case to.Endpoint == nil && from.Endpoint == nil:
+		return nil
+	case to.Endpoint == nil:
+		log.Infof("HAProxy: %v disabled", server)
+		return b.setServerState(server, "maint")
+	case from.Endpoint != nil && from.Endpoint.String() == to.Endpoint.String():
+		return nil
+	}
+
+	log.Infof("HAProxy: %v set to %v", server, to.Endpoint)
+
+	out, err := b.command(fmt.Sprintf("set server %v addr %v port %v", server, to.Endpoint.IP, to.Endpoint.Port))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, "changed") && !strings.Contains(out, "no need to change") {
+		return fmt.Errorf("set server %v addr: %v", server, out)
+	}
+
+	return b.setServerState(server, "ready")
+}
+
+func (b *haproxyBackend) setServerState(server string, state string) error {
+
+	out, err := b.command(fmt.Sprintf("set server %v state %v", server, state))
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		return fmt.Errorf("set server %v state: %v", server, out)
+	}
+
+	return nil
+}
+
+// command sends one command to the Runtime API, on a unix socket or a
+// host:port address, and returns its output
+func (b *haproxyBackend) command(cmd string) (string, error) {
+
+	network := "tcp"
+	if strings.HasPrefix(b.socket, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, b.socket, haproxyTimeout)
+	if err != nil {
+		return "", fmt.Errorf("Cannot connect to HAProxy runtime API: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(haproxyTimeout))
+
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", fmt.Errorf("Cannot send %q to HAProxy: %v", cmd, err)
+	}
+
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read HAProxy answer to %q: %v", cmd, err)
+	}
+
+	log.Debugf("HAProxy %q: %q", cmd, out)
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/moby/ipvs"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ipvsDrainPeriod = 10 * time.Second
+
+var ipvsForwardMethods = map[string]uint32{
+	"nat":    ipvs.ConnectionFlagMasq,
+	"dr":     ipvs.ConnectionFlagDirectRoute,
+	"tunnel": ipvs.ConnectionFlagTunnel,
+}
+
+var ipvsProtocols = map[string]uint16{
+	"TCP":  syscall.IPPROTO_TCP,
+	"UDP":  syscall.IPPROTO_UDP,
+	"SCTP": 132, // IPPROTO_SCTP
+}
+
+// schedulers matching the balance annotation, -ipvsScheduler otherwise
+var ipvsSchedulers = map[string]string{
+	"roundrobin": "rr",
+	"leastconn":  "lc",
+	"source":     "sh",
+}
+
+type ipvsVirtual struct {
+	service *ipvs.Service
+	reals   map[string]*ipvs.Destination
+}
+
+// ipvsBackend programs the kernel IPVS table over netlink: a virtual service
+// per service, with its endpoints as real servers. The table is reconciled,
+// only the virtual services created by this backend are ever removed, and
+// real servers going away are first drained with a weight of 0.
+type ipvsBackend struct {
+	sync.Mutex
+	handle    *ipvs.Handle
+	scheduler string
+	forward   uint32
+	desired   map[string]*ipvsVirtual
+	owned     map[string]bool
+}
+
+func init() {
+	registerBackend("ipvs", func() (Backend, error) {
+		forward, ok := ipvsForwardMethods[config.ipvsForward]
+		if !ok {
+			return nil, fmt.Errorf("unknown IPVS forwarding method %q", config.ipvsForward)
+		}
+
+		handle, err := ipvs.New("")
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open IPVS netlink socket: %v", err)
+		}
+
+		b := &ipvsBackend{
+			handle:    handle,
+			scheduler: config.ipvsScheduler,
+			forward:   forward,
+			owned:     make(map[string]bool),
+		}
+		go b.drainLoop()
+
+		return b, nil
+	})
+}
+
+func ipvsServiceKey(s *ipvs.Service) string {
+	return fmt.Sprintf("%v/%v", s.Protocol, net.JoinHostPort(s.Address.String(), fmt.Sprint(s.Port)))
+}
+
+func ipvsRealKey(d *ipvs.Destination) string {
+	return net.JoinHostPort(d.Address.String(), fmt.Sprint(d.Port))
+}
+
+func (b *ipvsBackend) virtual(service Service) (*ipvsVirtual, error) {
+
+	ip := net.ParseIP(service.LoadBalancerIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid LoadBalancerIP %q", service.LoadBalancerIP)
+	}
+
+	protocol, ok := ipvsProtocols[strings.ToUpper(service.Protocol)]
+	if !ok {
+		return nil, fmt.Errorf("protocol %v not supported", service.Protocol)
+	}
+
+	scheduler, ok := ipvsSchedulers[service.Options.Balance]
+	if !ok || service.Options.Balance == defaultServiceOptions.Balance {
+		scheduler = b.scheduler
+	}
+
+	vs := &ipvs.Service{
+		Address:       ip.To4(),
+		AddressFamily: syscall.AF_INET,
+		Netmask:       0xffffffff,
+		Protocol:      protocol,
+		Port:          uint16(service.Port),
+		SchedName:     scheduler,
+	}
+	if vs.Address == nil {
+		vs.Address = ip
+		vs.AddressFamily = syscall.AF_INET6
+		vs.Netmask = 128
+	}
+
+	v := &ipvsVirtual{service: vs, reals: make(map[string]*ipvs.Destination)}
+
+	for _, ep := range service.Backends {
+		epIP := net.ParseIP(ep.IP)
+		if epIP == nil {
+			continue
+		}
+		// IPVS only forwards within the address family of the VIP
+		if (epIP.To4() == nil) != (vs.AddressFamily == syscall.AF_INET6) {
+			log.Warnf("IPVS: service %v, real server %v skipped, not in the VIP address family", service.Name, ep)
+			continue
+		}
+
+		d := &ipvs.Destination{
+			Address:         epIP,
+			AddressFamily:   syscall.AF_INET6,
+			Port:            uint16(ep.Port),
+			Weight:          1,
+			ConnectionFlags: b.forward,
+		}
+		if v4 := epIP.To4(); v4 != nil {
+			d.Address = v4
+			d.AddressFamily = syscall.AF_INET
+		}
+		// terminating endpoints only keep their established connections
+		if !ep.Ready {
+			d.Weight = 0
+		}
+
+		v.reals[ipvsRealKey(d)] = d
+	}
+
+	return v, nil
+}
+
+func (b *ipvsBackend) Apply(ctx context.Context, services []Service) error {
+
+	desired := make(map[string]*ipvsVirtual)
+	for _, service := range services {
+		v, err := b.virtual(service)
+		if err != nil {
+			log.Warnf("IPVS: service %v skipped: %v", service.Name, err)
+			continue
+		}
+		desired[ipvsServiceKey(v.service)] = v
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.desired = desired
+	return b.reconcile()
+}
+
+// drainLoop reconciles periodically, to remove drained real servers once
+// their connections are gone
+func (b *ipvsBackend) drainLoop() {
+	for range time.NewTicker(ipvsDrainPeriod).C {
+		b.Lock()
+		if b.desired != nil {
+			if err := b.reconcile(); err != nil {
+				log.Errorf("IPVS: reconcile failed: %v", err)
+			}
+		}
+		b.Unlock()
+	}
+}
+
+// reconcile applies the desired virtual services, an error on one of them
+// does not prevent the others from being reconciled. Besides the virtual
+// services it created, the backend owns (and may remove) every virtual
+// service on a LoadBalancerIP, so leftovers from before a restart on an
+// address still in use are cleaned up too.
+func (b *ipvsBackend) reconcile() error {
+
+	current, err := b.handle.GetServices()
+	if err != nil {
+		return fmt.Errorf("Cannot list IPVS services: %v", err)
+	}
+
+	existing := make(map[string]*ipvs.Service)
+	for _, vs := range current {
+		existing[ipvsServiceKey(vs)] = vs
+	}
+
+	vips := make(map[string]bool)
+	var errs []string
+
+	for key, v := range b.desired {
+		vips[v.service.Address.String()] = true
+
+		vs, ok := existing[key]
+		switch {
+		case !ok:
+			log.Infof("IPVS: adding virtual service %v", key)
+			err = b.handle.NewService(v.service)
+		case vs.SchedName != v.service.SchedName:
+			log.Infof("IPVS: updating virtual service %v", key)
+			err = b.handle.UpdateService(v.service)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Cannot set IPVS service %v: %v", key, err))
+			err = nil
+			continue
+		}
+		b.owned[key] = true
+
+		if err := b.reconcileReals(key, v); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for key, vs := range existing {
+		if _, ok := b.desired[key]; ok || !(b.owned[key] || vips[vs.Address.String()]) {
+			continue
+		}
+		log.Infof("IPVS: removing virtual service %v", key)
+		if err := b.handle.DelService(vs); err != nil {
+			errs = append(errs, fmt.Sprintf("Cannot remove IPVS service %v: %v", key, err))
+			continue
+		}
+		delete(b.owned, key)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (b *ipvsBackend) reconcileReals(key string, v *ipvsVirtual) error {
+
+	current, err := b.handle.GetDestinations(v.service)
+	if err != nil {
+		return fmt.Errorf("Cannot list real servers of %v: %v", key, err)
+	}
+
+	existing := make(map[string]*ipvs.Destination)
+	for _, d := range current {
+		existing[ipvsRealKey(d)] = d
+	}
+
+	var errs []string
+
+	for rkey, d := range v.reals {
+		cur, ok := existing[rkey]
+		switch {
+		case !ok:
+			log.Infof("IPVS: %v adding real server %v", key, rkey)
+			err = b.handle.NewDestination(v.service, d)
+		case cur.Weight != d.Weight || cur.ConnectionFlags&ipvs.ConnectionFlagFwdMask != d.ConnectionFlags:
+			log.Infof("IPVS: %v updating real server %v, weight %v", key, rkey, d.Weight)
+			err = b.handle.UpdateDestination(v.service, d)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Cannot set real server %v of %v: %v", rkey, key, err))
+			err = nil
+		}
+	}
+
+	// real servers going away are drained before being removed
+	for rkey, d := range existing {
+		if _, ok := v.reals[rkey]; ok {
+			continue
+		}
+		switch {
+		case d.Weight != 0:
+			log.Infof("IPVS: %v draining real server %v", key, rkey)
+			d.Weight = 0
+			err = b.handle.UpdateDestination(v.service, d)
+		case d.ActiveConnections == 0:
+			log.Infof("IPVS: %v removing real server %v", key, rkey)
+			err = b.handle.DelDestination(v.service, d)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Cannot remove real server %v of %v: %v", rkey, key, err))
+			err = nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
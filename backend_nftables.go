@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const nftTable = "extlb"
+
+// nftablesBackend DNATs the services in the kernel with nftables, without any
+// proxy daemon. The ruleset lives in dedicated "extlb" tables (ip and ip6),
+// replaced as a whole in a single nft transaction, so other rules are left
+// untouched and a failed apply keeps the previous ruleset.
+type nftablesBackend struct {
+	nft        string
+	selection  string
+	masquerade bool
+	dryRun     bool
+}
+
+func init() {
+	registerBackend("nftables", func() (Backend, error) {
+		if config.nftSelection != "random" && config.nftSelection != "jhash" {
+			return nil, fmt.Errorf("unknown nftables endpoint selection %q", config.nftSelection)
+		}
+
+		return &nftablesBackend{
+			nft:        config.nftCommand,
+			selection:  config.nftSelection,
+			masquerade: config.nftMasquerade,
+			dryRun:     config.nftDryRun,
+		}, nil
+	})
+}
+
+// nftRule returns the DNAT rule of a service in the given family, "ip" or
+// "ip6", or an empty string if the service has no endpoint in that family
+func (b *nftablesBackend) nftRule(family string, service Service) string {
+
+	vip := net.ParseIP(service.LoadBalancerIP)
+	if vip == nil || (vip.To4() != nil) != (family == "ip") {
+		return ""
+	}
+
+	var elements []string
+	for _, ep := range activeEndpoints(service.Backends) {
+		ip := net.ParseIP(ep.IP)
+		if ip == nil || (ip.To4() != nil) != (family == "ip") {
+			continue
+		}
+		elements = append(elements, fmt.Sprintf("%d : %v . %d", len(elements), ip, ep.Port))
+	}
+	// without endpoints the traffic goes on to the host
+	if len(elements) == 0 {
+		return ""
+	}
+
+	selector := "numgen random"
+	if b.selection == "jhash" || service.Options.Balance == "source" || service.Options.Sticky {
+		selector = fmt.Sprintf("jhash %v saddr", family)
+	}
+
+	return fmt.Sprintf("\t\t%v daddr %v %v dport %d dnat %v addr . port to %v mod %d map { %v } comment \"%v\"\n",
+		family, vip, strings.ToLower(service.Protocol), service.Port, family,
+		selector, len(elements), strings.Join(elements, ", "), service.Name)
+}
+
+// ruleset builds the nft script replacing the extlb tables. Declaring each
+// table before deleting it makes the delete work even on the first run.
+func (b *nftablesBackend) ruleset(services []Service) []byte {
+
+	var buf bytes.Buffer
+
+	for _, family := range []string{"ip", "ip6"} {
+		fmt.Fprintf(&buf, "table %v %v\n", family, nftTable)
+		fmt.Fprintf(&buf, "delete table %v %v\n", family, nftTable)
+		fmt.Fprintf(&buf, "table %v %v {\n", family, nftTable)
+
+		fmt.Fprintf(&buf, "\tchain services {\n")
+		for _, service := range services {
+			buf.WriteString(b.nftRule(family, service))
+		}
+		fmt.Fprintf(&buf, "\t}\n")
+
+		fmt.Fprintf(&buf, "\tchain prerouting {\n")
+		fmt.Fprintf(&buf, "\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		fmt.Fprintf(&buf, "\t\tjump services\n")
+		fmt.Fprintf(&buf, "\t}\n")
+
+		// local clients
+		fmt.Fprintf(&buf, "\tchain output {\n")
+		fmt.Fprintf(&buf, "\t\ttype nat hook output priority -100; policy accept;\n")
+		fmt.Fprintf(&buf, "\t\tjump services\n")
+		fmt.Fprintf(&buf, "\t}\n")
+
+		// replies must come back through this box to be un-DNATed, which
+		// is not the case when it is not the default gateway of the pods
+		if b.masquerade {
+			addrType := map[string]string{"ip": "ipv4_addr", "ip6": "ipv6_addr"}[family]
+			var vips []string
+			for _, addr := range serviceAddresses(services) {
+				vip := net.ParseIP(addr)
+				if vip != nil && (vip.To4() != nil) == (family == "ip") {
+					vips = append(vips, vip.String())
+				}
+			}
+
+			fmt.Fprintf(&buf, "\tset vips {\n")
+			fmt.Fprintf(&buf, "\t\ttype %v;\n", addrType)
+			if len(vips) > 0 {
+				fmt.Fprintf(&buf, "\t\telements = { %v }\n", strings.Join(vips, ", "))
+			}
+			fmt.Fprintf(&buf, "\t}\n")
+
+			fmt.Fprintf(&buf, "\tchain postrouting {\n")
+			fmt.Fprintf(&buf, "\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+			fmt.Fprintf(&buf, "\t\tct status dnat ct original %v daddr @vips masquerade\n", family)
+			fmt.Fprintf(&buf, "\t}\n")
+		}
+
+		fmt.Fprintf(&buf, "}\n")
+	}
+
+	return buf.Bytes()
+}
+
+func (b *nftablesBackend) Apply(ctx context.Context, services []Service) error {
+
+	ruleset := b.ruleset(services)
+
+	if b.dryRun {
+		log.Infof("Dry run, nftables ruleset not applied")
+		_, err := os.Stdout.Write(ruleset)
+		return err
+	}
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, b.nft, "-f", "-")
+	cmd.Stdin = bytes.NewReader(ruleset)
+	out, err := cmd.CombinedOutput()
+	recordReload(err, start)
+	state.reloaded(err)
+	if err != nil {
+		log.Errorf("Failed to apply nftables ruleset, keeping the current one: %v\n%s", err, out)
+		return err
+	}
+
+	log.Infof("nftables ruleset applied")
+	recordConfigData("nftables", ruleset)
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateOutput is a template rendered into a config file, checked and
+// applied with its own reload script
+type templateOutput struct {
+	filter       outputFilter
+	tmplFile     string
+	configFile   string
+	reloadScript string
+	checkCommand string
+}
+
+// templateBackend renders the services into one or more outputs, the proxy
+// config or the -outputsFile ones, only reloading the ones whose content
+// changed.
+type templateBackend struct {
+	outputs []*templateOutput
+}
+
+func init() {
+	registerBackend("template", func() (Backend, error) {
+		if config.outputsFile == "" {
+			if strings.TrimSpace(config.reloadScript) == "" {
+				return nil, fmt.Errorf("empty reload script")
+			}
+			return &templateBackend{outputs: []*templateOutput{
+				newTemplateOutput(config.tmplFile, config.configFile, config.reloadScript, config.checkCommand),
+			}}, nil
+		}
+
+		outputs, err := loadOutputs(config.outputsFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDestinations(outputs); err != nil {
+			return nil, err
+		}
+
+		return &templateBackend{outputs: outputs}, nil
+	})
+}
+
+func newTemplateOutput(tmplFile string, configFile string, reloadScript string, checkCommand string) *templateOutput {
+	return &templateOutput{
+		tmplFile:     tmplFile,
+		configFile:   configFile,
+		reloadScript: reloadScript,
+		checkCommand: checkCommand,
+	}
+}
+
+// serviceAddresses returns the distinct LoadBalancerIPs of the services, sorted
+func serviceAddresses(services []Service) []string {
+
+	seen := make(map[string]bool)
+	var addresses []string
+
+	for _, s := range services {
+		if s.LoadBalancerIP == "" || seen[s.LoadBalancerIP] {
+			continue
+		}
+		seen[s.LoadBalancerIP] = true
+		addresses = append(addresses, s.LoadBalancerIP)
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// Apply renders every output with the services passing its filter, a
+// failing output does not prevent the others from being applied
+func (b *templateBackend) Apply(ctx context.Context, services []Service) error {
+
+	var firstErr error
+	for _, o := range b.outputs {
+		selected := o.filter.apply(services)
+
+		conf := make(map[string]interface{})
+		conf["services"] = selected
+		conf["addresses"] = serviceAddresses(selected)
+
+		if err := o.render(ctx, conf); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	// outputs left unchanged do not reload, clear a previous error here too
+	state.reloaded(firstErr)
+
+	return firstErr
+}
+
+// prepare renders and checks the config into a temporary file, returning an
+// empty name when the config file already has the rendered content
+func (b *templateOutput) prepare(conf map[string]interface{}) (string, error) {
+
+	sub, _, err := subTemplates.load(config.templatesDir)
+	if err != nil {
+		renderFailures.Inc()
+		log.Errorf("Failed to load templates: %v", err)
+		return "", err
+	}
+
+	t, err := template.New(filepath.Base(b.tmplFile)).
+		Funcs(templateFuncs).
+		Funcs(template.FuncMap{"include": includeFunc(sub)}).
+		ParseFiles(b.tmplFile)
+	if err != nil {
+		renderFailures.Inc()
+		log.Errorf("Failed to load template file: %v", err)
+		return "", err
+	}
+
+	tmpFile, err := renderConfig(t, conf, b.configFile)
+	if err != nil {
+		renderFailures.Inc()
+		log.Errorf("Failed to write config file: %v", err)
+		return "", err
+	}
+
+	if sameContent(tmpFile, b.configFile) {
+		os.Remove(tmpFile)
+		log.Debugf("Config file %v unchanged, no reload", b.configFile)
+		recordConfig(b.configFile)
+		return "", nil
+	}
+
+	if b.checkCommand != "" {
+		err = checkConfig(b.checkCommand, tmpFile)
+		if err != nil {
+			os.Remove(tmpFile)
+			log.Errorf("Invalid config, keeping the current one: %v", err)
+			return "", err
+		}
+	}
+
+	return tmpFile, nil
+}
+
+// save writes the config file without reloading the proxy, for changes
+// already applied at runtime, so that a restart picks them up
+func (b *templateOutput) save(conf map[string]interface{}) error {
+
+	tmpFile, err := b.prepare(conf)
+	if err != nil || tmpFile == "" {
+		return err
+	}
+
+	if err := os.Rename(tmpFile, b.configFile); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	log.Infof("Write config file: %v, no reload", b.configFile)
+	recordConfig(b.configFile)
+
+	return nil
+}
+
+// render executes the template with conf, checks the result, swaps it in and
+// reloads the proxy, restoring the previous config if the reload fails.
+// Nothing is done when the config file already has the rendered content.
+func (b *templateOutput) render(ctx context.Context, conf map[string]interface{}) error {
+
+	tmpFile, err := b.prepare(conf)
+	if err != nil || tmpFile == "" {
+		return err
+	}
+
+	// keep the current config, known to be good, to restore it on failure
+	prevFile := b.configFile + ".prev"
+	hasPrev := copyFile(b.configFile, prevFile) == nil
+
+	err = os.Rename(tmpFile, b.configFile)
+	if err != nil {
+		os.Remove(tmpFile)
+		log.Errorf("Failed to write config file: %v", err)
+		return err
+	}
+	log.Infof("Write config file: %v", b.configFile)
+
+	log.Infof("Ready to reload proxy")
+
+	err = reloadProxy(b.reloadScript)
+	state.reloaded(err)
+	if err == nil {
+		recordConfig(b.configFile)
+		return nil
+	}
+	log.Errorf("Error reloading proxy: %v", err)
+
+	if !hasPrev {
+		return err
+	}
+
+	if rerr := os.Rename(prevFile, b.configFile); rerr != nil {
+		log.Errorf("Failed to restore previous config file: %v", rerr)
+		return err
+	}
+
+	log.Warnf("Previous config file restored, reloading proxy")
+	if rerr := reloadProxy(b.reloadScript); rerr != nil {
+		log.Errorf("Error reloading proxy with previous config: %v", rerr)
+	} else {
+		recordConfig(b.configFile)
+	}
+
+	return fmt.Errorf("reload failed, previous config restored: %v", err)
+}
+
+// renderConfig executes the template into a temporary file next to
+// configFile, so it can then be renamed into place atomically
+func renderConfig(t *template.Template, data interface{}, configFile string) (string, error) {
+
+	w, err := ioutil.TempFile(filepath.Dir(configFile), "."+filepath.Base(configFile)+".")
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Execute(w, data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(w.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(w.Name())
+		return "", err
+	}
+
+	return w.Name(), nil
+}
+
+// checkConfig runs the check command with the config file as last argument
+func checkConfig(checkCommand string, file string) error {
+
+	args := append(strings.Fields(checkCommand), file)
+
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("check command failed: %v\n%s", err, out)
+	}
+
+	log.Debugf("Check command succeed:\n%s", out)
+	return nil
+}
+
+// commandArgs splits a command line on spaces, unless it is the path of an
+// existing file, which may then contain spaces
+func commandArgs(command string) []string {
+
+	if _, err := os.Stat(command); err == nil {
+		return []string{command}
+	}
+
+	return strings.Fields(command)
+}
+
+// reloadProxy runs the reload script, which may be a command with arguments
+func reloadProxy(reloadScript string) error {
+
+	args := commandArgs(reloadScript)
+	if len(args) == 0 {
+		return fmt.Errorf("no reload script")
+	}
+
+	start := time.Now()
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	recordReload(err, start)
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+
+	log.Infof("Reload script succeed:\n%s", out)
+	return nil
+}
+
+func sameContent(file1 string, file2 string) bool {
+
+	data1, err := ioutil.ReadFile(file1)
+	if err != nil {
+		return false
+	}
+	data2, err := ioutil.ReadFile(file2)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(data1, data2)
+}
+
+func copyFile(src string, dst string) error {
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dst, data, 0644)
+}
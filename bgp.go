@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/protobuf/types/known/anypb"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	bgpFamilyIPv4 = &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+	bgpFamilyIPv6 = &api.Family{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST}
+)
+
+// bgpSpeaker announces the LoadBalancerIPs of the services as host routes to
+// the configured peers, with this node as next hop, so that several nodes
+// can share the traffic through ECMP
+type bgpSpeaker struct {
+	server      *server.BgpServer
+	communities []uint32
+	paths       map[string]*api.Path
+}
+
+// parseCommunities parses "asn:value,..." standard communities
+func parseCommunities(s string) ([]uint32, error) {
+
+	var communities []uint32
+
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		parts := strings.SplitN(c, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid community %q", c)
+		}
+		asn, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q: %v", c, err)
+		}
+		value, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q: %v", c, err)
+		}
+
+		communities = append(communities, uint32(asn<<16|value))
+	}
+
+	return communities, nil
+}
+
+func newBGPSpeaker(ctx context.Context) (*bgpSpeaker, error) {
+
+	communities, err := parseCommunities(config.bgpCommunities)
+	if err != nil {
+		return nil, err
+	}
+
+	s := server.NewBgpServer()
+	go s.Serve()
+
+	err = s.StartBgp(ctx, &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:        uint32(config.bgpASN),
+			RouterId:   config.bgpRouterID,
+			ListenPort: int32(config.bgpListenPort),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot start BGP speaker: %v", err)
+	}
+
+	for _, peer := range strings.Split(config.bgpPeers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+
+		err = s.AddPeer(ctx, &api.AddPeerRequest{
+			Peer: &api.Peer{
+				Conf: &api.PeerConf{
+					NeighborAddress: peer,
+					PeerAsn:         uint32(config.bgpPeerASN),
+				},
+				Timers: &api.Timers{
+					Config: &api.TimersConfig{
+						HoldTime:          uint64(config.bgpHoldTime),
+						KeepaliveInterval: uint64(config.bgpHoldTime / 3),
+					},
+				},
+				AfiSafis: []*api.AfiSafi{
+					{Config: &api.AfiSafiConfig{Family: bgpFamilyIPv4, Enabled: true}},
+					{Config: &api.AfiSafiConfig{Family: bgpFamilyIPv6, Enabled: true}},
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot add BGP peer %v: %v", peer, err)
+		}
+		log.Infof("BGP peer added: %v, AS %v", peer, config.bgpPeerASN)
+	}
+
+	return &bgpSpeaker{
+		server:      s,
+		communities: communities,
+		paths:       make(map[string]*api.Path),
+	}, nil
+}
+
+// hostRoute builds the /32 or /128 path of ip. The next hop is left
+// unspecified for the speaker to use its own address on each session.
+func (b *bgpSpeaker) hostRoute(ip net.IP) (*api.Path, error) {
+
+	family, prefixLen, nextHop := bgpFamilyIPv4, uint32(32), "0.0.0.0"
+	if ip.To4() == nil {
+		family, prefixLen, nextHop = bgpFamilyIPv6, 128, "::"
+	}
+
+	nlri, err := anypb.New(&api.IPAddressPrefix{Prefix: ip.String(), PrefixLen: prefixLen})
+	if err != nil {
+		return nil, err
+	}
+
+	origin, err := anypb.New(&api.OriginAttribute{Origin: 0}) // IGP
+	if err != nil {
+		return nil, err
+	}
+	attrs := []*anypb.Any{origin}
+
+	var hop *anypb.Any
+	if family == bgpFamilyIPv4 {
+		hop, err = anypb.New(&api.NextHopAttribute{NextHop: nextHop})
+	} else {
+		hop, err = anypb.New(&api.MpReachNLRIAttribute{Family: family, NextHops: []string{nextHop}, Nlris: []*anypb.Any{nlri}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	attrs = append(attrs, hop)
+
+	if len(b.communities) > 0 {
+		communities, err := anypb.New(&api.CommunitiesAttribute{Communities: b.communities})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, communities)
+	}
+
+	return &api.Path{Family: family, Nlri: nlri, Pattrs: attrs}, nil
+}
+
+// sync announces the addresses of the services and withdraws the ones no
+// longer used, services without endpoints being already left out
+func (b *bgpSpeaker) sync(ctx context.Context, services []Service) {
+
+	desired := make(map[string]net.IP)
+	for _, s := range services {
+		if ip := net.ParseIP(s.LoadBalancerIP); ip != nil {
+			desired[ip.String()] = ip
+		}
+	}
+
+	for key, ip := range desired {
+		if _, ok := b.paths[key]; ok {
+			continue
+		}
+
+		path, err := b.hostRoute(ip)
+		if err != nil {
+			log.Errorf("Failed to build route for %v: %v", key, err)
+			continue
+		}
+
+		log.Infof("Announcing %v over BGP", key)
+		if _, err := b.server.AddPath(ctx, &api.AddPathRequest{Path: path}); err != nil {
+			log.Errorf("Failed to announce %v: %v", key, err)
+			continue
+		}
+		b.paths[key] = path
+	}
+
+	for key, path := range b.paths {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+
+		log.Infof("Withdrawing %v from BGP", key)
+		if err := b.server.DeletePath(ctx, &api.DeletePathRequest{Family: path.Family, Path: path}); err != nil {
+			log.Errorf("Failed to withdraw %v: %v", key, err)
+			continue
+		}
+		delete(b.paths, key)
+	}
+}
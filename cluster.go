@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// clusterConfig is an entry of the -clusters file
+type clusterConfig struct {
+	Name       string `json:"name"`
+	KubeConfig string `json:"kubeConfig"`
+	Context    string `json:"context"`
+	FilterType string `json:"filterType"`
+	IPPools    string `json:"ipPools"`
+}
+
+// cluster holds everything watching and writing to one api-server
+type cluster struct {
+	name    string
+	client  *k8s.Client
+	cache   *serviceCache
+	elector *leaderElector
+	status  *statusWriter
+	ipam    *ipAllocator
+	events  *eventRecorder
+}
+
+func loadClusters(path string) ([]clusterConfig, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read clusters file: %v", err)
+	}
+
+	var clusters []clusterConfig
+	if err := yaml.Unmarshal(data, &clusters); err != nil {
+		return nil, fmt.Errorf("unmarshal clusters file: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, c := range clusters {
+		if c.Name == "" {
+			return nil, fmt.Errorf("cluster without name in %v", path)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("cluster %v declared twice in %v", c.Name, path)
+		}
+		names[c.Name] = true
+	}
+
+	if err := checkPoolsOverlap(clusters); err != nil {
+		return nil, err
+	}
+
+	return clusters, nil
+}
+
+// checkPoolsOverlap fails when the pools of two clusters share addresses:
+// each cluster has its own allocator, which would hand the same address to
+// two services rendered in the same config
+func checkPoolsOverlap(clusters []clusterConfig) error {
+
+	type clusterRange struct {
+		cluster string
+		pool    string
+		r       ipRange
+	}
+	var ranges []clusterRange
+
+	for _, c := range clusters {
+		pools, err := parsePools(c.IPPools)
+		if err != nil {
+			return fmt.Errorf("cluster %v: invalid IP pools: %v", c.Name, err)
+		}
+		for _, p := range pools {
+			for _, r := range p.ranges {
+				ranges = append(ranges, clusterRange{c.Name, p.name, r})
+			}
+		}
+	}
+
+	for i, a := range ranges {
+		for _, b := range ranges[i+1:] {
+			if a.cluster != b.cluster && a.r.overlaps(b.r) {
+				return fmt.Errorf("IP pool %v of cluster %v overlaps pool %v of cluster %v", a.pool, a.cluster, b.pool, b.cluster)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newCluster connects to the cluster and does the initial sync of its cache.
+// All the clusters signal their changes on the same channel.
+func newCluster(ctx context.Context, cfg clusterConfig, changed chan struct{}) (*cluster, error) {
+
+	client, err := loadClient(cfg.KubeConfig, cfg.Context)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create client: %v", err)
+	}
+
+	pools, err := parsePools(cfg.IPPools)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse IP pools: %v", err)
+	}
+
+	cache := newServiceCache(client, cfg.FilterType, config.endpointsAPI == "endpointslices", changed)
+	err = cache.start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed initial sync: %v", err)
+	}
+
+	c := &cluster{
+		name:   cfg.Name,
+		client: client,
+		cache:  cache,
+		status: newStatusWriter(client, cache),
+	}
+
+	if config.leaderElect {
+		c.elector, err = newLeaderElector(client, config.leaseNamespace, config.leaseName, config.leaderIdentity,
+			time.Duration(config.leaseDuration)*time.Second,
+			time.Duration(config.renewDeadline)*time.Second,
+			time.Duration(config.retryPeriod)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to setup leader election: %v", err)
+		}
+		c.elector.onChange = cache.notify
+		go c.elector.run(ctx)
+	}
+
+	c.events = newEventRecorder(client, c.elector.isLeader)
+
+	if len(pools) > 0 {
+		c.ipam = newIPAllocator(client, cache, pools)
+	}
+
+	return c, nil
+}
+
+// servicesOf returns the services backed by the cluster
+func (c *cluster) servicesOf(services []Service) (clusterServices []Service) {
+	for _, service := range services {
+		for _, name := range service.Clusters {
+			if name == c.name {
+				clusterServices = append(clusterServices, service)
+				break
+			}
+		}
+	}
+	return clusterServices
+}
+
+// mergeServices merges the services with the same namespace, name and port
+// coming from different clusters into one, with the endpoints of all of them
+func mergeServices(services []Service) (merged []Service) {
+
+	index := make(map[string]int)
+
+	for _, service := range services {
+		key := getServiceNameForLBRule("", service.Namespace, service.ServiceName, service.Port)
+
+		i, ok := index[key]
+		if !ok {
+			service.Name = key
+			service.Backends = append([]Endpoint(nil), service.Backends...)
+			index[key] = len(merged)
+			merged = append(merged, service)
+			continue
+		}
+
+		m := &merged[i]
+		if m.LoadBalancerIP != service.LoadBalancerIP {
+			log.Warnf("Service %v has different LoadBalancerIP in clusters %v and %v, keeping %v",
+				key, m.Cluster, service.Cluster, m.LoadBalancerIP)
+		}
+		if m.TargetPort != service.TargetPort {
+			m.TargetPort = 0
+		}
+		m.Cluster = m.Cluster + "+" + service.Cluster
+		m.Clusters = append(m.Clusters, service.Clusters...)
+		m.Backends = append(m.Backends, service.Backends...)
+	}
+
+	for i := range merged {
+		merged[i].Endpoints = endpointAddresses(merged[i].Backends)
+	}
+
+	return merged
+}
+
+func clusterNames(clusters []*cluster) string {
+	names := make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	"net/url"
+	"sort"
+)
+
+// discovery.k8s.io/v1 types, the k8s client does not ship them
+
+const (
+	endpointSlicesPath = "/apis/discovery.k8s.io/v1/endpointslices"
+	serviceNameLabel   = "kubernetes.io/service-name"
+)
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+type objectReference struct {
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type endpointConditions struct {
+	Ready       *bool `json:"ready,omitempty"`
+	Serving     *bool `json:"serving,omitempty"`
+	Terminating *bool `json:"terminating,omitempty"`
+}
+
+type sliceEndpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions endpointConditions `json:"conditions"`
+	Hostname   string             `json:"hostname,omitempty"`
+	TargetRef  *objectReference   `json:"targetRef,omitempty"`
+	NodeName   string             `json:"nodeName,omitempty"`
+	Zone       string             `json:"zone,omitempty"`
+}
+
+type slicePort struct {
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Port     *int32 `json:"port,omitempty"`
+}
+
+type endpointSlice struct {
+	Metadata    objectMeta      `json:"metadata"`
+	AddressType string          `json:"addressType"`
+	Endpoints   []sliceEndpoint `json:"endpoints"`
+	Ports       []slicePort     `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*endpointSlice `json:"items"`
+}
+
+// serviceKey returns the cache key of the Service owning the slice
+func (s *endpointSlice) serviceKey() (string, bool) {
+	name, ok := s.Metadata.Labels[serviceNameLabel]
+	return cacheKey(s.Metadata.Namespace, name), ok
+}
+
+// ready, serving and terminating follow the API defaults for unset conditions
+func (c endpointConditions) ready() bool {
+	return c.Ready == nil || *c.Ready
+}
+
+func (c endpointConditions) serving() bool {
+	if c.Serving == nil {
+		return c.ready()
+	}
+	return *c.Serving
+}
+
+func (c endpointConditions) terminating() bool {
+	return c.Terminating != nil && *c.Terminating
+}
+
+func (c *serviceCache) loadEndpointSlices(ctx context.Context) (string, error) {
+
+	var list endpointSliceList
+	err := apiRequest(ctx, c.client, "GET", endpointSlicesPath, "", nil, &list)
+	if err != nil {
+		return "", fmt.Errorf("Cannot list endpoint slices: %v", err)
+	}
+
+	m := make(map[string]map[string]*endpointSlice)
+	for _, s := range list.Items {
+		key, ok := s.serviceKey()
+		if !ok {
+			continue
+		}
+		if m[key] == nil {
+			m[key] = make(map[string]*endpointSlice)
+		}
+		m[key][s.Metadata.Name] = s
+	}
+
+	c.Lock()
+	c.slices = m
+	c.Unlock()
+	c.notify()
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (c *serviceCache) watchEndpointSlices(ctx context.Context, rv string) error {
+
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", rv)
+
+	return apiWatch(ctx, c.client, endpointSlicesPath+"?"+q.Encode(), func(event string, object json.RawMessage) error {
+
+		s := new(endpointSlice)
+		if err := json.Unmarshal(object, s); err != nil {
+			return fmt.Errorf("Cannot decode endpoint slice: %v", err)
+		}
+
+		key, ok := s.serviceKey()
+		if !ok {
+			return nil
+		}
+		log.Debugf("EndpointSlice event %v: %v/%v", event, s.Metadata.Namespace, s.Metadata.Name)
+
+		c.Lock()
+		switch event {
+		case k8s.EventAdded, k8s.EventModified:
+			if c.slices[key] == nil {
+				c.slices[key] = make(map[string]*endpointSlice)
+			}
+			c.slices[key][s.Metadata.Name] = s
+		case k8s.EventDeleted:
+			delete(c.slices[key], s.Metadata.Name)
+			if len(c.slices[key]) == 0 {
+				delete(c.slices, key)
+			}
+		}
+		c.Unlock()
+		c.notify()
+
+		return nil
+	})
+}
+
+// getEndpointSlices returns all the slices of a Service, sorted by name
+func (c *serviceCache) getEndpointSlices(namespace string, name string) ([]*endpointSlice, bool) {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	m, ok := c.slices[cacheKey(namespace, name)]
+	if !ok {
+		return nil, false
+	}
+
+	slices := make([]*endpointSlice, 0, len(m))
+	for _, s := range m {
+		slices = append(slices, s)
+	}
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Metadata.Name < slices[j].Metadata.Name })
+
+	return slices, true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	eventComponent  = "k8s-external-lb"
+	eventInterval   = 5 * time.Minute
+	eventTTL        = 1 * time.Hour
+	eventMessageMax = 1024
+)
+
+type recordedEvent struct {
+	event *corev1.Event
+	last  time.Time
+}
+
+// eventRecorder publishes Events on Services. The same event is emitted at
+// most once per eventInterval, repeats bump the count of the existing Event
+// instead of creating a new one.
+type eventRecorder struct {
+	sync.Mutex
+	client  *k8s.Client
+	host    string
+	enabled func() bool
+	events  map[string]*recordedEvent
+}
+
+func newEventRecorder(client *k8s.Client, enabled func() bool) *eventRecorder {
+	host, _ := os.Hostname()
+	return &eventRecorder{
+		client:  client,
+		host:    host,
+		enabled: enabled,
+		events:  make(map[string]*recordedEvent),
+	}
+}
+
+func eventTime(t time.Time) *metav1.Time {
+	seconds := t.Unix()
+	return &metav1.Time{
+		Seconds: &seconds,
+		Nanos:   k8s.Int32(int32(t.Nanosecond())),
+	}
+}
+
+func (r *eventRecorder) emit(s *corev1.Service, eventType string, reason string, message string) {
+
+	if r == nil || s == nil || (r.enabled != nil && !r.enabled()) {
+		return
+	}
+
+	if len(message) > eventMessageMax {
+		message = message[:eventMessageMax]
+	}
+
+	meta := s.GetMetadata()
+	key := fmt.Sprintf("%v/%v/%v/%v", meta.GetNamespace(), meta.GetName(), reason, message)
+	now := time.Now()
+
+	r.Lock()
+	defer r.Unlock()
+
+	for k, e := range r.events {
+		if now.Sub(e.last) > eventTTL {
+			delete(r.events, k)
+		}
+	}
+
+	if e, ok := r.events[key]; ok {
+		if now.Sub(e.last) < eventInterval {
+			return
+		}
+
+		e.event.Count = k8s.Int32(*e.event.Count + 1)
+		e.event.LastTimestamp = eventTime(now)
+		err := r.client.Update(context.Background(), e.event)
+		if err == nil {
+			e.last = now
+			return
+		}
+		log.Debugf("Cannot update event %v, creating a new one: %v", key, err)
+	}
+
+	event := &corev1.Event{
+		Metadata: &metav1.ObjectMeta{
+			Name:      k8s.String(fmt.Sprintf("%v.%x", meta.GetName(), now.UnixNano())),
+			Namespace: k8s.String(meta.GetNamespace()),
+		},
+		InvolvedObject: &corev1.ObjectReference{
+			Kind:            k8s.String("Service"),
+			ApiVersion:      k8s.String("v1"),
+			Namespace:       k8s.String(meta.GetNamespace()),
+			Name:            k8s.String(meta.GetName()),
+			Uid:             k8s.String(meta.GetUid()),
+			ResourceVersion: k8s.String(meta.GetResourceVersion()),
+		},
+		Reason:  k8s.String(reason),
+		Message: k8s.String(message),
+		Source: &corev1.EventSource{
+			Component: k8s.String(eventComponent),
+			Host:      k8s.String(r.host),
+		},
+		FirstTimestamp: eventTime(now),
+		LastTimestamp:  eventTime(now),
+		Count:          k8s.Int32(1),
+		Type:           k8s.String(eventType),
+	}
+
+	err := r.client.Create(context.Background(), event)
+	if err != nil {
+		log.Errorf("Failed to create event %v on service %v/%v: %v", reason, meta.GetNamespace(), meta.GetName(), err)
+		return
+	}
+
+	r.events[key] = &recordedEvent{event: event, last: now}
+}
+
+func (r *eventRecorder) normal(s *corev1.Service, reason string, format string, args ...interface{}) {
+	r.emit(s, "Normal", reason, fmt.Sprintf(format, args...))
+}
+
+func (r *eventRecorder) warning(s *corev1.Service, reason string, format string, args ...interface{}) {
+	r.emit(s, "Warning", reason, fmt.Sprintf(format, args...))
+}
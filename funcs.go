@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are the functions available to the templates, on top of the
+// text/template builtins. As in sprig, the piped value is the last argument:
+// {{ .Name | replace "." "_" }}, {{ .list | join "," }}.
+var templateFuncs = template.FuncMap{
+	// strings
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old string, new string, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains":   func(substr string, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) },
+	"split":      func(sep string, s string) []string { return strings.Split(s, sep) },
+	"join":       join,
+	"quote":      strconv.Quote,
+	"default":    defaultValue,
+
+	// lists
+	"list":      func(items ...interface{}) []interface{} { return items },
+	"first":     first,
+	"last":      last,
+	"has":       has,
+	"uniq":      uniq,
+	"sortAlpha": sortAlpha,
+
+	// math, on any integer type
+	"add": func(a interface{}, b interface{}) int64 { return toInt64(a) + toInt64(b) },
+	"sub": func(a interface{}, b interface{}) int64 { return toInt64(a) - toInt64(b) },
+	"mul": func(a interface{}, b interface{}) int64 { return toInt64(a) * toInt64(b) },
+	"div": divide,
+	"mod": modulo,
+	"max": maxInt,
+	"min": minInt,
+
+	// dicts
+	"dict":   dict,
+	"get":    get,
+	"hasKey": hasKey,
+	"keys":   keys,
+
+	// load balancing
+	"endpointIP":    endpointIP,
+	"endpointPort":  endpointPort,
+	"joinHostPort":  func(host string, port interface{}) string { return net.JoinHostPort(host, fmt.Sprint(port)) },
+	"isIPv6":        isIPv6,
+	"sanitizeName":  sanitizeName,
+	"sortEndpoints": sortEndpoints,
+	"sha256":        sha256Sum,
+}
+
+// strList converts any slice or array to strings
+func strList(list interface{}) []string {
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []string{fmt.Sprint(list)}
+	}
+
+	l := make([]string, v.Len())
+	for i := range l {
+		l[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+
+	return l
+}
+
+func join(sep string, list interface{}) string {
+	return strings.Join(strList(list), sep)
+}
+
+// defaultValue returns value, or def when value is the zero value of its type
+func defaultValue(def interface{}, value interface{}) interface{} {
+
+	if value == nil {
+		return def
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		if v.Len() == 0 {
+			return def
+		}
+	default:
+		if v.IsZero() {
+			return def
+		}
+	}
+
+	return value
+}
+
+func first(list interface{}) (interface{}, error) {
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("first: %T is not a list", list)
+	}
+	if v.Len() == 0 {
+		return nil, nil
+	}
+
+	return v.Index(0).Interface(), nil
+}
+
+func last(list interface{}) (interface{}, error) {
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("last: %T is not a list", list)
+	}
+	if v.Len() == 0 {
+		return nil, nil
+	}
+
+	return v.Index(v.Len() - 1).Interface(), nil
+}
+
+func has(item interface{}, list interface{}) bool {
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		if reflect.DeepEqual(v.Index(i).Interface(), item) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uniq returns the strings of list without duplicates, in order
+func uniq(list interface{}) []string {
+
+	seen := make(map[string]bool)
+	var l []string
+
+	for _, s := range strList(list) {
+		if !seen[s] {
+			seen[s] = true
+			l = append(l, s)
+		}
+	}
+
+	return l
+}
+
+func sortAlpha(list interface{}) []string {
+
+	l := strList(list)
+	sort.Strings(l)
+
+	return l
+}
+
+func toInt64(v interface{}) int64 {
+
+	if s, ok := v.(string); ok {
+		i, _ := strconv.ParseInt(s, 10, 64)
+		return i
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	}
+
+	return 0
+}
+
+func maxInt(a interface{}, b interface{}) int64 {
+	if toInt64(a) > toInt64(b) {
+		return toInt64(a)
+	}
+	return toInt64(b)
+}
+
+func minInt(a interface{}, b interface{}) int64 {
+	if toInt64(a) < toInt64(b) {
+		return toInt64(a)
+	}
+	return toInt64(b)
+}
+
+func divide(a interface{}, b interface{}) (int64, error) {
+	if toInt64(b) == 0 {
+		return 0, fmt.Errorf("div: division by zero")
+	}
+	return toInt64(a) / toInt64(b), nil
+}
+
+func modulo(a interface{}, b interface{}) (int64, error) {
+	if toInt64(b) == 0 {
+		return 0, fmt.Errorf("mod: division by zero")
+	}
+	return toInt64(a) % toInt64(b), nil
+}
+
+// dict builds a map from key, value pairs
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments")
+	}
+
+	d := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		d[fmt.Sprint(pairs[i])] = pairs[i+1]
+	}
+
+	return d, nil
+}
+
+// keys returns the sorted keys of any map
+// mapIndex looks key up in any map with string keys, dict or the
+// Annotations and Labels of a service
+func mapIndex(m interface{}, key string) (reflect.Value, reflect.Value, error) {
+
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return v, reflect.Value{}, fmt.Errorf("%T is not a dict", m)
+	}
+
+	return v, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())), nil
+}
+
+// get returns the value of key, the zero value when it is missing
+func get(m interface{}, key string) (interface{}, error) {
+
+	v, value, err := mapIndex(m, key)
+	if err != nil {
+		return nil, fmt.Errorf("get: %v", err)
+	}
+	if !value.IsValid() {
+		return reflect.Zero(v.Type().Elem()).Interface(), nil
+	}
+
+	return value.Interface(), nil
+}
+
+func hasKey(m interface{}, key string) (bool, error) {
+
+	_, value, err := mapIndex(m, key)
+	if err != nil {
+		return false, fmt.Errorf("hasKey: %v", err)
+	}
+
+	return value.IsValid(), nil
+}
+
+func keys(m interface{}) ([]string, error) {
+
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map {
+		return nil, fmt.Errorf("keys: %T is not a dict", m)
+	}
+
+	l := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		l = append(l, fmt.Sprint(k.Interface()))
+	}
+	sort.Strings(l)
+
+	return l, nil
+}
+
+// endpointIP returns the address of an "ip:port" endpoint
+func endpointIP(endpoint string) (string, error) {
+
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	return host, nil
+}
+
+// endpointPort returns the port of an "ip:port" endpoint
+func endpointPort(endpoint string) (string, error) {
+
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	return port, nil
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// sanitizeName makes s usable as a proxy section or server name
+func sanitizeName(s string) string {
+	return unsafeNameChars.ReplaceAllString(s, "_")
+}
+
+// sortEndpoints returns a copy of the endpoints sorted by IP then port
+func sortEndpoints(endpoints []Endpoint) []Endpoint {
+
+	sorted := append([]Endpoint(nil), endpoints...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].IP != sorted[j].IP {
+			return bytes.Compare(net.ParseIP(sorted[i].IP).To16(), net.ParseIP(sorted[j].IP).To16()) < 0
+		}
+		return sorted[i].Port < sorted[j].Port
+	})
+
+	return sorted
+}
+
+func sha256Sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+func TestDefaultValue(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"nil", nil, "def"},
+		{"empty string", "", "def"},
+		{"string", "value", "value"},
+		{"zero int", 0, "def"},
+		{"int", 42, 42},
+		{"zero int32", int32(0), "def"},
+		{"false", false, "def"},
+		{"true", true, true},
+		{"empty list", []string{}, "def"},
+		{"list", []string{"a"}, []string{"a"}},
+		{"empty dict", map[string]interface{}{}, "def"},
+	}
+
+	for _, tt := range tests {
+		if got := defaultValue("def", tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: defaultValue(%#v) = %#v, want %#v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+
+	tests := []struct {
+		list      interface{}
+		wantFirst interface{}
+		wantLast  interface{}
+		wantErr   bool
+	}{
+		{[]string{}, nil, nil, false},
+		{[]int(nil), nil, nil, false},
+		{[]string{"a"}, "a", "a", false},
+		{[]int{1, 2, 3}, 1, 3, false},
+		{"not a list", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := first(tt.list)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.wantFirst) {
+			t.Errorf("first(%#v) = %#v, %v, want %#v", tt.list, got, err, tt.wantFirst)
+		}
+		got, err = last(tt.list)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.wantLast) {
+			t.Errorf("last(%#v) = %#v, %v, want %#v", tt.list, got, err, tt.wantLast)
+		}
+	}
+}
+
+func TestDivMod(t *testing.T) {
+
+	tests := []struct {
+		a, b    interface{}
+		wantDiv int64
+		wantMod int64
+		wantErr bool
+	}{
+		{7, 2, 3, 1, false},
+		{int32(9), 3, 3, 0, false},
+		{"10", int64(4), 2, 2, false},
+		{1, 0, 0, 0, true},
+		{1, int32(0), 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := divide(tt.a, tt.b)
+		if (err != nil) != tt.wantErr || got != tt.wantDiv {
+			t.Errorf("div %v %v = %v, %v, want %v", tt.a, tt.b, got, err, tt.wantDiv)
+		}
+		got, err = modulo(tt.a, tt.b)
+		if (err != nil) != tt.wantErr || got != tt.wantMod {
+			t.Errorf("mod %v %v = %v, %v, want %v", tt.a, tt.b, got, err, tt.wantMod)
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+
+	tests := []struct {
+		pairs   []interface{}
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{nil, map[string]interface{}{}, false},
+		{[]interface{}{"a", 1, "b", "2"}, map[string]interface{}{"a": 1, "b": "2"}, false},
+		{[]interface{}{1, true}, map[string]interface{}{"1": true}, false},
+		{[]interface{}{"a"}, nil, true},
+		{[]interface{}{"a", 1, "b"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := dict(tt.pairs...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("dict(%v) error = %v, want error %v", tt.pairs, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dict(%v) = %v, want %v", tt.pairs, got, tt.want)
+		}
+	}
+}
+
+func TestGetHasKey(t *testing.T) {
+
+	tests := []struct {
+		m       interface{}
+		key     string
+		want    interface{}
+		wantHas bool
+		wantErr bool
+	}{
+		{map[string]interface{}{"a": 1}, "a", 1, true, false},
+		{map[string]interface{}{"a": 1}, "b", nil, false, false},
+		{map[string]string{"a": "1"}, "a", "1", true, false},
+		{map[string]string{"a": "1"}, "b", "", false, false},
+		{map[string]string(nil), "a", "", false, false},
+		{map[int]string{1: "1"}, "1", nil, false, true},
+		{"not a dict", "a", nil, false, true},
+	}
+
+	for _, tt := range tests {
+		got, err := get(tt.m, tt.key)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("get(%#v, %q) = %#v, %v, want %#v", tt.m, tt.key, got, err, tt.want)
+		}
+		has, err := hasKey(tt.m, tt.key)
+		if (err != nil) != tt.wantErr || has != tt.wantHas {
+			t.Errorf("hasKey(%#v, %q) = %v, %v, want %v", tt.m, tt.key, has, err, tt.wantHas)
+		}
+	}
+}
+
+func TestEndpointIPPort(t *testing.T) {
+
+	tests := []struct {
+		endpoint string
+		wantIP   string
+		wantPort string
+		wantErr  bool
+	}{
+		{"10.0.0.1:8080", "10.0.0.1", "8080", false},
+		{"[::1]:80", "::1", "80", false},
+		{"[fd00::1]:443", "fd00::1", "443", false},
+		{"10.0.0.1", "", "", true},
+		{"::1:80", "", "", true},
+	}
+
+	for _, tt := range tests {
+		ip, err := endpointIP(tt.endpoint)
+		if (err != nil) != tt.wantErr || ip != tt.wantIP {
+			t.Errorf("endpointIP(%q) = %q, %v, want %q", tt.endpoint, ip, err, tt.wantIP)
+		}
+		port, err := endpointPort(tt.endpoint)
+		if (err != nil) != tt.wantErr || port != tt.wantPort {
+			t.Errorf("endpointPort(%q) = %q, %v, want %q", tt.endpoint, port, err, tt.wantPort)
+		}
+	}
+}
+
+func TestIsIPv6(t *testing.T) {
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"::1", true},
+		{"fd00::10", true},
+		{"10.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"", false},
+		{"not an ip", false},
+	}
+
+	for _, tt := range tests {
+		if got := isIPv6(tt.ip); got != tt.want {
+			t.Errorf("isIPv6(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"default_web_80", "default_web_80"},
+		{"my-app.v2", "my-app.v2"},
+		{"a b/c", "a_b_c"},
+		{"ns/svc:80", "ns_svc_80"},
+		{"tab\tand  spaces", "tab_and_spaces"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeName(tt.name); got != tt.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortEndpoints(t *testing.T) {
+
+	tests := []struct {
+		endpoints []Endpoint
+		want      []Endpoint
+	}{
+		{nil, nil},
+		{
+			[]Endpoint{{IP: "10.0.0.10", Port: 80}, {IP: "10.0.0.9", Port: 81}, {IP: "10.0.0.9", Port: 80}},
+			[]Endpoint{{IP: "10.0.0.9", Port: 80}, {IP: "10.0.0.9", Port: 81}, {IP: "10.0.0.10", Port: 80}},
+		},
+		{
+			[]Endpoint{{IP: "fd00::a", Port: 80}, {IP: "fd00::2", Port: 80}},
+			[]Endpoint{{IP: "fd00::2", Port: 80}, {IP: "fd00::a", Port: 80}},
+		},
+	}
+
+	for _, tt := range tests {
+		input := append([]Endpoint(nil), tt.endpoints...)
+		if got := sortEndpoints(input); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortEndpoints(%v) = %v, want %v", tt.endpoints, got, tt.want)
+		}
+		if !reflect.DeepEqual(input, tt.endpoints) {
+			t.Errorf("sortEndpoints(%v) modified its argument", tt.endpoints)
+		}
+	}
+}
+
+// TestTemplateFuncs checks the functions through templates, with the piped
+// value as last argument
+func TestTemplateFuncs(t *testing.T) {
+
+	tests := []struct {
+		tmpl string
+		data interface{}
+		want string
+	}{
+		{`{{ "A.b" | lower | replace "." "_" }}`, nil, "a_b"},
+		{`{{ .list | join "," }}`, map[string]interface{}{"list": []string{"a", "b"}}, "a,b"},
+		{`{{ list "b" "a" "b" | uniq | sortAlpha | join "," }}`, nil, "a,b"},
+		{`{{ "" | default "none" }}`, nil, "none"},
+		{`{{ add 1 .port }} {{ sub 10 3 }} {{ mul 2 3 }} {{ max 2 5 }} {{ min 2 5 }}`, map[string]interface{}{"port": int32(79)}, "80 7 6 5 2"},
+		{`{{ $d := dict "b" 2 "a" 1 }}{{ keys $d | join "," }} {{ get $d "b" }} {{ hasKey $d "c" }}`, nil, "a,b 2 false"},
+		{`{{ endpointIP "[::1]:80" }} {{ endpointPort "[::1]:80" }}`, nil, "::1 80"},
+		{`{{ joinHostPort "::1" 80 }} {{ isIPv6 "::1" }}`, nil, "[::1]:80 true"},
+		{`{{ sha256 "" }}`, nil, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{`{{ get .Annotations "a" }} {{ get .Annotations "b" | default "none" }}`, Service{Annotations: map[string]string{"a": "1"}}, "1 none"},
+		{`{{ hasKey .Annotations "a" }} {{ hasKey .Labels "a" }}`, Service{Annotations: map[string]string{"a": "1"}}, "true false"},
+		{`{{ has "b" (list "a" "b") }} {{ has "c" (list "a" "b") }}`, nil, "true false"},
+		{`{{ "www.example.com" | trimPrefix "www." | trimSuffix ".com" }}`, nil, "example"},
+		{`{{ "extlb/template" | contains "/" }} {{ "extlb" | contains "/" }}`, nil, "true false"},
+		{`{{ "a,b,,c" | split "," | join ";" }}`, nil, "a;b;;c"},
+		{`{{ "a\tb" | quote }}`, nil, `"a\tb"`},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs).Parse(tt.tmpl)
+		if err != nil {
+			t.Errorf("%v: parse: %v", tt.tmpl, err)
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, tt.data); err != nil {
+			t.Errorf("%v: execute: %v", tt.tmpl, err)
+			continue
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%v = %q, want %q", tt.tmpl, buf.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// syncState tracks the outcome of the sync loop for the health endpoints
+type syncState struct {
+	sync.RWMutex
+	ready     bool
+	lastSync  time.Time
+	reloadErr error
+	services  []Service
+	started   time.Time
+}
+
+var state = syncState{started: time.Now()}
+
+// synced records a successful GetServices plus configureServices cycle
+func (s *syncState) synced(services []Service) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.ready = true
+	s.lastSync = time.Now()
+	s.services = services
+}
+
+func (s *syncState) reloaded(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.reloadErr = err
+}
+
+// healthy fails when the last reload failed or no sync succeeded within
+// window, counted from the process start until the first sync
+func (s *syncState) healthy(window time.Duration) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.reloadErr != nil {
+		return fmt.Errorf("last reload failed: %v", s.reloadErr)
+	}
+	if !s.ready && time.Since(s.started) > window {
+		return fmt.Errorf("no successful sync since start at %v", s.started.Format(time.RFC3339))
+	}
+	if s.ready && time.Since(s.lastSync) > window {
+		return fmt.Errorf("no successful sync since %v", s.lastSync.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := state.healthy(time.Duration(config.healthWindow) * time.Second); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	state.RLock()
+	ready := state.ready
+	state.RUnlock()
+
+	if !ready {
+		http.Error(w, "initial sync not done", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// debugStateHandler dumps the last applied services
+func debugStateHandler(w http.ResponseWriter, r *http.Request) {
+	state.RLock()
+	services := state.services
+	state.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(services); err != nil {
+		log.Errorf("Failed to encode state: %v", err)
+	}
+}
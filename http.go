@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+func serveHTTP(addr string) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/debug/state", debugStateHandler)
+
+	log.Infof("Serving HTTP on %v", addr)
+	log.Fatalf("HTTP server failed: %v", http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"net"
+	"strings"
+)
+
+const (
+	annotationPrefix      = "extlb/"
+	annotationPool        = annotationPrefix + "pool"
+	annotationAllocatedIP = annotationPrefix + "allocated-ip"
+	defaultPool           = "default"
+)
+
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	if len(ip) != len(r.first) {
+		return false
+	}
+	return bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+func (r ipRange) overlaps(o ipRange) bool {
+	if len(r.first) != len(o.first) {
+		return false
+	}
+	return bytes.Compare(r.first, o.last) <= 0 && bytes.Compare(o.first, r.last) <= 0
+}
+
+type ipPool struct {
+	name   string
+	ranges []ipRange
+}
+
+func (p *ipPool) contains(ip net.IP) bool {
+	for _, r := range p.ranges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the first address of the pool not in used, or nil
+func (p *ipPool) next(used map[string]bool) net.IP {
+	for _, r := range p.ranges {
+		for ip := r.first; r.contains(ip); ip = nextIP(ip) {
+			if !used[ip.String()] {
+				return ip
+			}
+			if ip.Equal(r.last) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeIP returns ip in its 4 bytes form for IPv4, 16 bytes for IPv6
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func parseIPRange(s string) (ipRange, error) {
+
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, err
+		}
+
+		first := normalizeIP(ipnet.IP)
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipnet.Mask[i]
+		}
+
+		// skip network and broadcast addresses of IPv4 subnets
+		if ones, bits := ipnet.Mask.Size(); bits == 32 && ones < 31 {
+			first = nextIP(first)
+			last[len(last)-1]--
+		}
+
+		return ipRange{first, last}, nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return ipRange{}, fmt.Errorf("invalid range %q, expected CIDR or first-last", s)
+	}
+
+	first := net.ParseIP(strings.TrimSpace(bounds[0]))
+	last := net.ParseIP(strings.TrimSpace(bounds[1]))
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	first, last = normalizeIP(first), normalizeIP(last)
+	if len(first) != len(last) || bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	return ipRange{first, last}, nil
+}
+
+// parsePools reads pools definitions in the form
+// "name=cidr|first-last,...;name2=..."
+func parsePools(spec string) (map[string]*ipPool, error) {
+
+	pools := make(map[string]*ipPool)
+
+	for _, def := range strings.Split(spec, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		kv := strings.SplitN(def, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid pool %q, expected name=ranges", def)
+		}
+
+		pool := &ipPool{name: strings.TrimSpace(kv[0])}
+		for _, s := range strings.Split(kv[1], ",") {
+			r, err := parseIPRange(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("pool %v: %v", pool.name, err)
+			}
+			pool.ranges = append(pool.ranges, r)
+		}
+
+		if _, ok := pools[pool.name]; ok {
+			return nil, fmt.Errorf("pool %v declared twice", pool.name)
+		}
+		pools[pool.name] = pool
+	}
+
+	return pools, nil
+}
+
+// ipAllocator assigns addresses from the pools to LoadBalancer Services
+// without spec.loadBalancerIP. Assignments are recorded in an annotation on
+// the Service itself, so the allocator state is rebuilt from the cache at
+// every pass and an address is released as soon as its Service is gone.
+type ipAllocator struct {
+	client *k8s.Client
+	cache  *serviceCache
+	pools  map[string]*ipPool
+}
+
+func newIPAllocator(client *k8s.Client, cache *serviceCache, pools map[string]*ipPool) *ipAllocator {
+	return &ipAllocator{
+		client: client,
+		cache:  cache,
+		pools:  pools,
+	}
+}
+
+func patchServiceAnnotation(ctx context.Context, client *k8s.Client, ref serviceRef, key string, value string) error {
+
+	var v interface{}
+	if value != "" {
+		v = value
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				key: v,
+			},
+		},
+	}
+
+	path := fmt.Sprintf("/api/v1/namespaces/%v/services/%v", ref.namespace, ref.name)
+	return apiRequest(ctx, client, "PATCH", path, mergePatchType, patch, nil)
+}
+
+// wantsAllocation tells if the Service should get an address from a pool
+func wantsAllocation(s *corev1.Service) bool {
+	return s.GetSpec().GetType() == "LoadBalancer" && s.GetSpec().GetLoadBalancerIP() == ""
+}
+
+func poolName(s *corev1.Service) string {
+	if name, ok := s.GetMetadata().GetAnnotations()[annotationPool]; ok && name != "" {
+		return name
+	}
+	return defaultPool
+}
+
+func (a *ipAllocator) allocate(ctx context.Context) {
+
+	svcs := a.cache.listServices()
+	used := make(map[string]bool)
+
+	// explicit addresses are never handed out
+	for _, s := range svcs {
+		if ip := net.ParseIP(s.GetSpec().GetLoadBalancerIP()); ip != nil {
+			used[normalizeIP(ip).String()] = true
+		}
+	}
+
+	var pending []*corev1.Service
+
+	for _, s := range svcs {
+		ref := serviceRef{s.GetMetadata().GetNamespace(), s.GetMetadata().GetName()}
+		allocated := s.GetMetadata().GetAnnotations()[annotationAllocatedIP]
+
+		if !wantsAllocation(s) {
+			if allocated != "" {
+				a.release(ctx, ref, allocated)
+			}
+			continue
+		}
+
+		pool, ok := a.pools[poolName(s)]
+		if !ok {
+			log.Debugf("Service %v/%v: unknown pool %v", ref.namespace, ref.name, poolName(s))
+			continue
+		}
+
+		// keep the recorded address if it is still valid and not claimed yet
+		ip := net.ParseIP(allocated)
+		if ip != nil && pool.contains(normalizeIP(ip)) && !used[normalizeIP(ip).String()] {
+			used[normalizeIP(ip).String()] = true
+			continue
+		}
+
+		pending = append(pending, s)
+	}
+
+	for _, s := range pending {
+		ref := serviceRef{s.GetMetadata().GetNamespace(), s.GetMetadata().GetName()}
+		pool := a.pools[poolName(s)]
+
+		ip := pool.next(used)
+		if ip == nil {
+			log.Errorf("Service %v/%v: pool %v is exhausted", ref.namespace, ref.name, pool.name)
+			continue
+		}
+
+		err := patchServiceAnnotation(ctx, a.client, ref, annotationAllocatedIP, ip.String())
+		if err != nil {
+			log.Errorf("Failed to record allocated IP for service %v/%v: %v", ref.namespace, ref.name, err)
+			continue
+		}
+
+		log.Infof("Service %v/%v allocated %v from pool %v", ref.namespace, ref.name, ip, pool.name)
+		used[ip.String()] = true
+	}
+}
+
+func (a *ipAllocator) release(ctx context.Context, ref serviceRef, ip string) {
+
+	err := patchServiceAnnotation(ctx, a.client, ref, annotationAllocatedIP, "")
+	if err != nil && !isNotFound(err) {
+		log.Errorf("Failed to release IP %v of service %v/%v: %v", ip, ref.namespace, ref.name, err)
+		return
+	}
+
+	log.Infof("Service %v/%v released %v", ref.namespace, ref.name, ip)
+}
+
+// serviceLoadBalancerIP returns the address a Service is served on, either
+// its spec.loadBalancerIP or the one allocated from a pool
+func serviceLoadBalancerIP(s *corev1.Service) string {
+	if ip := s.GetSpec().GetLoadBalancerIP(); ip != "" {
+		return ip
+	}
+	return s.GetMetadata().GetAnnotations()[annotationAllocatedIP]
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	"sync/atomic"
+	"time"
+)
+
+// coordination.k8s.io/v1 types, the k8s client does not ship them
+
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+type microTime struct {
+	time.Time
+}
+
+func (t microTime) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + t.UTC().Format(microTimeFormat) + `"`), nil
+}
+
+func (t *microTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := time.Parse(`"`+microTimeFormat+`"`, string(b))
+	if err != nil {
+		return err
+	}
+	t.Time = v
+	return nil
+}
+
+type leaseSpec struct {
+	HolderIdentity       string     `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int32      `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *microTime `json:"acquireTime,omitempty"`
+	RenewTime            *microTime `json:"renewTime,omitempty"`
+	LeaseTransitions     int32      `json:"leaseTransitions,omitempty"`
+}
+
+type lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       leaseSpec  `json:"spec"`
+}
+
+// leaderElector holds a Lease to elect one leader among the replicas. Only
+// the leader performs cluster writes, every replica renders its own config.
+// A nil leaderElector is always leader.
+type leaderElector struct {
+	client        *k8s.Client
+	name          string
+	namespace     string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+	onChange      func()
+
+	leader       int32
+	observed     leaseSpec
+	observedTime time.Time
+	lastRenew    time.Time
+}
+
+func newLeaderElector(client *k8s.Client, namespace string, name string, identity string,
+	leaseDuration time.Duration, renewDeadline time.Duration, retryPeriod time.Duration) (*leaderElector, error) {
+
+	if renewDeadline >= leaseDuration {
+		return nil, fmt.Errorf("renew deadline must be shorter than lease duration")
+	}
+	if retryPeriod >= renewDeadline {
+		return nil, fmt.Errorf("retry period must be shorter than renew deadline")
+	}
+
+	return &leaderElector{
+		client:        client,
+		name:          name,
+		namespace:     namespace,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: renewDeadline,
+		retryPeriod:   retryPeriod,
+	}, nil
+}
+
+func (e *leaderElector) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+
+	var v int32
+	if leader {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&e.leader, v) == v {
+		return
+	}
+
+	if leader {
+		log.Infof("Leader election: %v is now the leader", e.identity)
+	} else {
+		log.Warnf("Leader election: %v lost the leadership", e.identity)
+	}
+
+	if e.onChange != nil {
+		e.onChange()
+	}
+}
+
+func (e *leaderElector) path() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases/%v", e.namespace, e.name)
+}
+
+// tryAcquireOrRenew creates or updates the Lease with our identity, unless
+// it is held by another replica and not expired yet
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+
+	now := time.Now()
+	spec := leaseSpec{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int32(e.leaseDuration / time.Second),
+		AcquireTime:          &microTime{now},
+		RenewTime:            &microTime{now},
+	}
+
+	var l lease
+	err := apiRequest(ctx, e.client, "GET", e.path(), "", nil, &l)
+	if isNotFound(err) {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   objectMeta{Name: e.name, Namespace: e.namespace},
+			Spec:       spec,
+		}
+		path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases", e.namespace)
+		if err := apiRequest(ctx, e.client, "POST", path, "application/json", &l, nil); err != nil {
+			return false, err
+		}
+		e.observed, e.observedTime = spec, now
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// expiry is computed from the local time we observed the last change,
+	// so clocks of the replicas do not need to agree
+	if l.Spec.HolderIdentity != e.observed.HolderIdentity || !renewTimeEqual(l.Spec.RenewTime, e.observed.RenewTime) {
+		e.observed, e.observedTime = l.Spec, now
+	}
+
+	held := l.Spec.HolderIdentity != "" && l.Spec.HolderIdentity != e.identity
+	if held && e.observedTime.Add(e.leaseDuration).After(now) {
+		return false, nil
+	}
+
+	if l.Spec.HolderIdentity == e.identity {
+		spec.AcquireTime = l.Spec.AcquireTime
+		spec.LeaseTransitions = l.Spec.LeaseTransitions
+	} else {
+		spec.LeaseTransitions = l.Spec.LeaseTransitions + 1
+	}
+	l.Spec = spec
+
+	// the resourceVersion in metadata makes the update fail on conflict
+	if err := apiRequest(ctx, e.client, "PUT", e.path(), "application/json", &l, nil); err != nil {
+		return false, err
+	}
+
+	e.observed, e.observedTime = spec, now
+	return true, nil
+}
+
+func renewTimeEqual(a *microTime, b *microTime) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b.Time)
+}
+
+// run tries to acquire or renew the Lease every retry period, until ctx is
+// cancelled. The leadership is lost when it could not be renewed within the
+// renew deadline.
+func (e *leaderElector) run(ctx context.Context) {
+
+	for {
+		ok, err := e.tryAcquireOrRenew(ctx)
+		switch {
+		case ok:
+			e.lastRenew = time.Now()
+			e.setLeader(true)
+		case err != nil:
+			if isConflict(err) {
+				log.Debugf("Leader election: lease %v/%v updated concurrently", e.namespace, e.name)
+			} else {
+				log.Errorf("Leader election: failed to update lease %v/%v: %v", e.namespace, e.name, err)
+			}
+			if e.isLeader() && time.Since(e.lastRenew) > e.renewDeadline {
+				e.setLeader(false)
+			}
+		default:
+			log.Debugf("Leader election: lease %v/%v held by %v", e.namespace, e.name, e.observed.HolderIdentity)
+			e.setLeader(false)
+		}
+
+		select {
+		case <-ctx.Done():
+			e.setLeader(false)
+			return
+		case <-time.After(e.retryPeriod):
+		}
+	}
+}
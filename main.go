@@ -3,140 +3,373 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/ericchiang/k8s"
 	corev1 "github.com/ericchiang/k8s/apis/core/v1"
-	"github.com/ghodss/yaml"
 	"github.com/namsral/flag"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
+	"net"
 	"os"
-	"os/exec"
 	"reflect"
-	"text/template"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	kubeConfig   string
+	kubeContext  string
+	backend      string
 	tmplFile     string
 	configFile   string
 	reloadScript string
+	checkCommand string
+	outputsFile  string
+	templatesDir string
 	filterType   string
+	ipPools      string
+	endpointsAPI string
 	syncPeriod   int
-	debug        bool
+
+	clustersFile  string
+	mergeClusters bool
+
+	haproxySocket string
+	haproxySlots  int
+	envoyListen   string
+	ipvsScheduler string
+	ipvsForward   string
+	nftCommand    string
+	nftSelection  string
+	nftMasquerade bool
+	nftDryRun     bool
+
+	vipInterface string
+	vipStateFile string
+
+	bgpASN         int
+	bgpRouterID    string
+	bgpListenPort  int
+	bgpPeers       string
+	bgpPeerASN     int
+	bgpCommunities string
+	bgpHoldTime    int
+
+	listenAddress string
+	healthWindow  int
+
+	leaderElect    bool
+	leaderIdentity string
+	leaseName      string
+	leaseNamespace string
+	leaseDuration  int
+	renewDeadline  int
+	retryPeriod    int
+
+	debug bool
+}
+
+type EndpointRef struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+type Endpoint struct {
+	Cluster     string
+	IP          string
+	Port        int32
+	Hostname    string
+	TargetRef   EndpointRef
+	NodeName    string
+	Zone        string
+	Ready       bool
+	Serving     bool
+	Terminating bool
+}
+
+// String returns the "ip:port" form of the endpoint
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.IP, strconv.Itoa(int(e.Port)))
 }
 
 type Service struct {
+	Cluster        string
+	Clusters       []string
 	Name           string
 	Namespace      string
+	ServiceName    string
 	Endpoints      []string
+	Backends       []Endpoint
 	Port           int32
 	TargetPort     int32
+	Protocol       string
 	LoadBalancerIP string
+	Options        ServiceOptions
+	Annotations    map[string]string
+	Labels         map[string]string
 }
 
 var config Config
 var log = logrus.New()
 
-func loadClient(kubeconfigPath string) (*k8s.Client, error) {
+// Endpoint ports are named after the service port they serve, so matching
+// on the name resolves numeric as well as named targetPorts, the same way
+// kube-proxy does. The resolved port can differ from one subset to another.
+func endpointsFromEndpoints(ep *corev1.Endpoints, servicePort *corev1.ServicePort) (endpoints []Endpoint) {
 
-	data, err := ioutil.ReadFile(kubeconfigPath)
-	if err != nil {
-		return nil, fmt.Errorf("read kubeconfig: %v", err)
-	}
-
-	var cfg k8s.Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("unmarshal kubeconfig: %v", err)
+	for _, ss := range ep.Subsets {
+		var targetPort int32
+		for _, epPort := range ss.Ports {
+			if epPort.GetName() == servicePort.GetName() {
+				targetPort = epPort.GetPort()
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, epAddress := range ss.Addresses {
+			ref := epAddress.GetTargetRef()
+			endpoints = append(endpoints, Endpoint{
+				IP:       *epAddress.Ip,
+				Port:     targetPort,
+				Hostname: epAddress.GetHostname(),
+				TargetRef: EndpointRef{
+					Kind:      ref.GetKind(),
+					Name:      ref.GetName(),
+					Namespace: ref.GetNamespace(),
+				},
+				NodeName: epAddress.GetNodeName(),
+				Ready:    true,
+				Serving:  true,
+			})
+		}
 	}
 
-	return k8s.NewClient(&cfg)
+	return endpoints
 }
 
-func getServiceEndpoints(client *k8s.Client, name string, namespace string, servicePort *corev1.ServicePort) (endpoints []string, err error) {
+func endpointsFromSlices(slices []*endpointSlice, servicePort *corev1.ServicePort, addressType string) (endpoints []Endpoint) {
 
-	var ep corev1.Endpoints
-	err = client.Get(context.Background(), namespace, name, &ep)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get endpoints: %v", err)
-	}
+	seen := make(map[string]bool)
 
-	if *ep.Metadata.Name == name && *ep.Metadata.Namespace == namespace {
-		for _, ss := range ep.Subsets {
-			var targetPort int32
-			for _, epPort := range ss.Ports {
-				if *epPort.Port == servicePort.TargetPort.GetIntVal() {
-					targetPort = *epPort.Port
-				}
+	for _, slice := range slices {
+		// FQDN slices hold hostnames, and a dual-stack Service has one set
+		// of slices per family: keep the family of the LoadBalancerIP only
+		if slice.AddressType != addressType {
+			continue
+		}
+
+		var targetPort int32
+		for _, slicePort := range slice.Ports {
+			if slicePort.Port != nil && slicePort.Name == servicePort.GetName() {
+				targetPort = *slicePort.Port
 			}
-			if targetPort == 0 {
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, sliceEp := range slice.Endpoints {
+			// only keep ready endpoints, and terminating ones still serving
+			cond := sliceEp.Conditions
+			if !cond.ready() && !(cond.serving() && cond.terminating()) {
 				continue
 			}
-			for _, epAddress := range ss.Addresses {
-				endpoints = append(endpoints, fmt.Sprintf("%v:%v", *epAddress.Ip, targetPort))
+			// an endpoint can show up in two slices while it moves between them
+			if len(sliceEp.Addresses) == 0 || seen[sliceEp.Addresses[0]] {
+				continue
 			}
+			seen[sliceEp.Addresses[0]] = true
+
+			var ref EndpointRef
+			if sliceEp.TargetRef != nil {
+				ref = EndpointRef{
+					Kind:      sliceEp.TargetRef.Kind,
+					Name:      sliceEp.TargetRef.Name,
+					Namespace: sliceEp.TargetRef.Namespace,
+				}
+			}
+
+			endpoints = append(endpoints, Endpoint{
+				IP:          sliceEp.Addresses[0],
+				Port:        targetPort,
+				Hostname:    sliceEp.Hostname,
+				TargetRef:   ref,
+				NodeName:    sliceEp.NodeName,
+				Zone:        sliceEp.Zone,
+				Ready:       cond.ready(),
+				Serving:     cond.serving(),
+				Terminating: cond.terminating(),
+			})
+		}
+	}
+
+	return endpoints
+}
+
+// sliceAddressType returns the EndpointSlice address type matching ip
+func sliceAddressType(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func getServiceEndpoints(cache *serviceCache, name string, namespace string, servicePort *corev1.ServicePort, lbIP string) (endpoints []Endpoint, err error) {
 
+	if cache.useSlices {
+		slices, ok := cache.getEndpointSlices(namespace, name)
+		if !ok {
+			return nil, fmt.Errorf("Cannot get endpoint slices: not found in cache")
 		}
-		log.Debugf(" -> Found Endpoints: %v", endpoints)
+		endpoints = endpointsFromSlices(slices, servicePort, sliceAddressType(lbIP))
+	} else {
+		ep, ok := cache.getEndpoints(namespace, name)
+		if !ok {
+			return nil, fmt.Errorf("Cannot get endpoints: not found in cache")
+		}
+		endpoints = endpointsFromEndpoints(ep, servicePort)
 	}
 
+	log.Debugf(" -> Found Endpoints: %+v", endpoints)
+
 	return endpoints, nil
 }
 
-func getServiceNameForLBRule(s *corev1.Service, servicePort int32) string {
-	return fmt.Sprintf("%v_%v_%v", *s.Metadata.Namespace, *s.Metadata.Name, servicePort)
+// activeEndpoints returns the ready endpoints, or the terminating ones when
+// none is ready
+func activeEndpoints(endpoints []Endpoint) (active []Endpoint) {
+
+	for _, ep := range endpoints {
+		if ep.Ready {
+			active = append(active, ep)
+		}
+	}
+
+	if len(active) == 0 {
+		active = append(active, endpoints...)
+	}
+
+	return active
+}
+
+// endpointAddresses returns the "ip:port" form of the active endpoints
+func endpointAddresses(endpoints []Endpoint) (addresses []string) {
+
+	for _, ep := range activeEndpoints(endpoints) {
+		addresses = append(addresses, ep.String())
+	}
+
+	return addresses
 }
 
-func getServices(client *k8s.Client, filter string) (services []Service, err error) {
+// getServiceTargetPort returns the numeric targetPort of a service port. For
+// named targetPorts, it is the port resolved on endpoints if they all agree,
+// 0 otherwise, templates must then use the per-endpoint port.
+func getServiceTargetPort(servicePort *corev1.ServicePort, endpoints []Endpoint) int32 {
 
-	var svcs corev1.ServiceList
+	targetPort := servicePort.GetTargetPort()
+	if targetPort == nil {
+		return servicePort.GetPort()
+	}
+	if targetPort.GetType() == 0 {
+		return targetPort.GetIntVal()
+	}
 
-	ls := new(k8s.LabelSelector)
-	if filter != "" {
-		ls.Eq("lb_type", filter)
+	var port int32
+	for _, ep := range endpoints {
+		if port != 0 && ep.Port != port {
+			return 0
+		}
+		port = ep.Port
 	}
 
-	err = client.List(context.Background(), k8s.AllNamespaces, &svcs, ls.Selector())
+	return port
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("Cannot list services: %v", err)
+func getServiceProtocol(servicePort *corev1.ServicePort) string {
+	if protocol := servicePort.GetProtocol(); protocol != "" {
+		return protocol
 	}
+	return "TCP"
+}
+
+func getServiceNameForLBRule(cluster string, namespace string, name string, servicePort int32) string {
+	if cluster != "" {
+		return fmt.Sprintf("%v_%v_%v_%v", cluster, namespace, name, servicePort)
+	}
+	return fmt.Sprintf("%v_%v_%v", namespace, name, servicePort)
+}
+
+func getServices(c *cluster) (services []Service) {
 
-	for _, s := range svcs.Items {
+	cache, events := c.cache, c.events
+
+	for _, s := range cache.listServices() {
 
 		log.Debugf("Service Candidate : %v:%+v type=%+v", *s.Metadata.Namespace, *s.Metadata.Name, *s.Spec.Type)
 
 		if *s.Spec.Type != "LoadBalancer" {
 			log.Debugf(" - Dropped candidate : %+v, not loadbalancer type", *s.Metadata.Name)
+			// without filter every service of the cluster is a candidate
+			if cache.filter != "" {
+				events.warning(s, "NotLoadBalancerType", "Service has the lb_type label but is of type %v", *s.Spec.Type)
+			}
 			continue
 		}
 
-		if *s.Spec.LoadBalancerIP == "" {
+		lbIP := serviceLoadBalancerIP(s)
+		if lbIP == "" {
 			log.Debugf(" - Dropped candidate : %+v, no loadbalancer IP", *s.Metadata.Name)
+			events.warning(s, "MissingLoadBalancerIP", "No loadBalancerIP set and none allocated from a pool")
 			continue
 		}
 
+		options, annotations := getServiceOptions(s)
+
+		// an unknown sub-template must not break the config of every service
+		if options.Template != "" {
+			if err := subTemplates.check(config.templatesDir, options.Template); err != nil {
+				log.Debugf(" - Template %v of %v ignored: %v", options.Template, *s.Metadata.Name, err)
+				events.warning(s, "UnknownTemplate", "Template %v ignored, using the default one: %v", options.Template, err)
+				options.Template = ""
+			}
+		}
+
 		for _, servicePort := range s.Spec.Ports {
 
-			ep, err := getServiceEndpoints(client, *s.Metadata.Name, *s.Metadata.Namespace, servicePort)
+			ep, err := getServiceEndpoints(cache, *s.Metadata.Name, *s.Metadata.Namespace, servicePort, lbIP)
 			if err != nil {
 				log.Debugf(" - Cannot get service endpoints for service %v, port %v: %v", *s.Metadata.Name, servicePort, err)
 				log.Debugf(" - Dropped candidate : %+v", *s.Metadata.Name)
+				events.warning(s, "NoEndpoints", "Port %v dropped: %v", *servicePort.Port, err)
 				continue
 			}
 
 			if len(ep) == 0 {
 				log.Debugf(" - No endpoints found for service %v, port %v", *s.Metadata.Name, servicePort)
 				log.Debugf(" - Dropped candidate : %+v", *s.Metadata.Name)
+				events.warning(s, "NoEndpoints", "Port %v dropped: no ready endpoints", *servicePort.Port)
 				continue
 			}
 
+			for i := range ep {
+				ep[i].Cluster = c.name
+			}
+
 			cService := Service{
-				Name:           getServiceNameForLBRule(s, *servicePort.Port),
-				Endpoints:      ep,
+				Cluster:        c.name,
+				Clusters:       []string{c.name},
+				Name:           getServiceNameForLBRule(c.name, *s.Metadata.Namespace, *s.Metadata.Name, *servicePort.Port),
+				Namespace:      *s.Metadata.Namespace,
+				ServiceName:    *s.Metadata.Name,
+				Endpoints:      endpointAddresses(ep),
+				Backends:       ep,
 				Port:           *servicePort.Port,
-				TargetPort:     *servicePort.TargetPort.IntVal,
-				LoadBalancerIP: *s.Spec.LoadBalancerIP,
+				TargetPort:     getServiceTargetPort(servicePort, ep),
+				Protocol:       getServiceProtocol(servicePort),
+				LoadBalancerIP: lbIP,
+				Options:        options,
+				Annotations:    annotations,
+				Labels:         s.GetMetadata().GetLabels(),
 			}
 
 			services = append(services, cService)
@@ -145,10 +378,31 @@ func getServices(client *k8s.Client, filter string) (services []Service, err err
 		}
 	}
 
-	return services, nil
+	return services
 }
 
-func configureServices(services []Service, tmplFile string, configFile string) {
+// getAllServices gathers the services of all the clusters, merging them
+// across clusters when asked to
+func getAllServices(clusters []*cluster) (services []Service) {
+
+	start := time.Now()
+
+	for _, c := range clusters {
+		services = append(services, getServices(c)...)
+	}
+
+	if config.mergeClusters {
+		services = mergeServices(services)
+	}
+
+	recordServices(services, start)
+
+	return services
+}
+
+// applyServices configures the proxy and reports the outcome as Events on
+// the Services served
+func applyServices(ctx context.Context, backend Backend, clusters []*cluster, services []Service) bool {
 
 	for n, service := range services {
 		log.Infof("-+= Service #%v", n)
@@ -159,49 +413,87 @@ func configureServices(services []Service, tmplFile string, configFile string) {
 		log.Infof(" `--= Endpoints : %v", service.Endpoints)
 	}
 
-	t, err := template.ParseFiles(tmplFile)
-	if err != nil {
-		log.Errorf("Failed to load template file: %v", err)
-		return
-	}
+	err := backend.Apply(ctx, services)
 
-	w, err := os.Create(configFile)
-	if err != nil {
-		log.Errorf("Failed to open config file: %v", err)
-		return
+	for _, c := range clusters {
+		for _, service := range c.servicesOf(services) {
+			s, _ := c.cache.getService(service.Namespace, service.ServiceName)
+			if err != nil {
+				c.events.warning(s, "ReloadFailed", "Failed to apply load balancer config: %v", err)
+			} else {
+				c.events.normal(s, "ConfigApplied", "Load balancer configured on %v:%v", service.LoadBalancerIP, service.Port)
+			}
+		}
 	}
 
-	conf := make(map[string]interface{})
-	conf["services"] = services
+	return err == nil
+}
 
-	err = t.Execute(w, conf)
-	if err != nil {
-		log.Errorf("Failed to write config file: %v", err)
-		return
-	} else {
-		log.Infof("Write config file: %v", configFile)
+// allocateAddresses and updateStatus do the cluster writes, only on the
+// clusters we lead: IP allocation before the services are gathered, status
+// once they are applied
+func allocateAddresses(ctx context.Context, clusters []*cluster) {
+	for _, c := range clusters {
+		if c.ipam != nil && c.elector.isLeader() {
+			c.ipam.allocate(ctx)
+		}
 	}
+}
 
-	log.Infof("Ready to reload proxy")
-
-	out, err := exec.Command(config.reloadScript).CombinedOutput()
-	if err != nil {
-		log.Errorf("Error reloading proxy: %v\n%s", err, out)
-	} else {
-		log.Infof("Reload script succeed:\n%s", out)
+func updateStatus(ctx context.Context, clusters []*cluster, services []Service) {
+	for _, c := range clusters {
+		if c.elector.isLeader() {
+			c.status.update(ctx, c.servicesOf(services))
+		}
 	}
-
-	return
 }
 
 func init() {
 
-	flag.StringVar(&config.kubeConfig, "kubeConfig", os.Getenv("HOME")+"/.kube/config", "kubeconfig file to load")
+	hostname, _ := os.Hostname()
+
+	flag.StringVar(&config.kubeConfig, "kubeConfig", os.Getenv("HOME")+"/.kube/config", "kubeconfig file to load, in-cluster config is used when it does not exist inside a pod")
+	flag.StringVar(&config.kubeContext, "context", "", "kubeconfig context to use, default: current context")
+	flag.StringVar(&config.backend, "backend", "template", "Backend applying the services: "+strings.Join(backendNames(), ", "))
 	flag.StringVar(&config.tmplFile, "tmplFile", "config.tmpl", "Template file to load")
 	flag.StringVar(&config.configFile, "configFile", "config.conf", "Configuration file to write")
 	flag.StringVar(&config.reloadScript, "reloadScript", "./reload.sh", "Reload script to launch")
+	flag.StringVar(&config.checkCommand, "checkCommand", "", "Command validating the config file given as last argument before it is applied (e.g. \"haproxy -c -f\"), default: none")
+	flag.StringVar(&config.outputsFile, "outputsFile", "", "YAML file declaring the outputs (name, template, destination, reload, check, filter), replacing -tmplFile/-configFile (template backend), default: none")
+	flag.StringVar(&config.templatesDir, "templatesDir", "", "Directory of *.tmpl sub-templates, selected per service with the extlb/template annotation, default: none")
+	flag.StringVar(&config.haproxySocket, "haproxySocket", "/var/run/haproxy.sock", "HAProxy runtime API socket, unix path or host:port (haproxy backend)")
+	flag.IntVar(&config.haproxySlots, "haproxySlots", 10, "Minimum number of server slots per HAProxy backend (haproxy backend)")
+	flag.StringVar(&config.envoyListen, "envoyListen", ":18000", "Address to serve xDS on (envoy backend)")
+	flag.StringVar(&config.ipvsScheduler, "ipvsScheduler", "rr", "Default IPVS scheduler (ipvs backend)")
+	flag.StringVar(&config.ipvsForward, "ipvsForward", "nat", "IPVS forwarding method: nat, dr or tunnel (ipvs backend)")
+	flag.StringVar(&config.nftCommand, "nftCommand", "nft", "nft binary (nftables backend)")
+	flag.StringVar(&config.nftSelection, "nftSelection", "random", "Endpoint selection: random or jhash on the client address (nftables backend)")
+	flag.BoolVar(&config.nftMasquerade, "nftMasquerade", false, "Masquerade the DNATed connections, needed when this box is not the pods default gateway (nftables backend)")
+	flag.BoolVar(&config.nftDryRun, "nftDryRun", false, "Print the ruleset on stdout instead of applying it (nftables backend)")
+	flag.StringVar(&config.vipInterface, "vipInterface", "", "Interface to add the LoadBalancerIPs to, default: none, addresses are managed outside")
+	flag.StringVar(&config.vipStateFile, "vipStateFile", "vips.state", "File listing the IPv6 addresses added to -vipInterface, to remove them after a restart")
+	flag.IntVar(&config.bgpASN, "bgpASN", 0, "Local AS number, enables the BGP speaker announcing the LoadBalancerIPs, default: disabled")
+	flag.StringVar(&config.bgpRouterID, "bgpRouterID", "", "BGP router id, an IPv4 address of this node")
+	flag.IntVar(&config.bgpListenPort, "bgpListenPort", -1, "Port to accept BGP sessions on, default: -1, outgoing sessions only")
+	flag.StringVar(&config.bgpPeers, "bgpPeers", "", "Comma separated addresses of the BGP peers")
+	flag.IntVar(&config.bgpPeerASN, "bgpPeerASN", 0, "AS number of the BGP peers")
+	flag.StringVar(&config.bgpCommunities, "bgpCommunities", "", "Comma separated asn:value communities attached to the routes, default: none")
+	flag.IntVar(&config.bgpHoldTime, "bgpHoldTime", 90, "BGP hold time in seconds, keepalives are sent every third of it")
 	flag.StringVar(&config.filterType, "filterType", "", "Filter services on lb_type label, default: none")
-	flag.IntVar(&config.syncPeriod, "syncPeriod", 10, "Period between update")
+	flag.StringVar(&config.ipPools, "ipPools", "", "IP pools for services without loadBalancerIP, as name=cidr|first-last,...;name2=..., default: none")
+	flag.StringVar(&config.clustersFile, "clustersFile", "", "YAML file listing several clusters to watch (name, kubeConfig, context, filterType, ipPools), default: the cluster of -kubeConfig")
+	flag.BoolVar(&config.mergeClusters, "mergeClusters", false, "Merge services with the same namespace, name and port across clusters into one backend")
+	flag.StringVar(&config.endpointsAPI, "endpointsAPI", "endpointslices", "API to read service endpoints from: endpointslices or endpoints (older clusters)")
+	flag.IntVar(&config.syncPeriod, "syncPeriod", 300, "Period between full resync, in seconds")
+	flag.StringVar(&config.listenAddress, "listenAddress", ":8080", "Address to serve /metrics, /healthz, /readyz and /debug/state on, empty to disable")
+	flag.IntVar(&config.healthWindow, "healthWindow", 900, "Maximum duration without a successful sync before /healthz fails, in seconds")
+	flag.BoolVar(&config.leaderElect, "leaderElect", false, "Enable leader election, only the leader writes to the cluster")
+	flag.StringVar(&config.leaderIdentity, "leaderIdentity", hostname, "Identity of this replica in the leader election")
+	flag.StringVar(&config.leaseName, "leaseName", "k8s-external-lb", "Name of the leader election lease")
+	flag.StringVar(&config.leaseNamespace, "leaseNamespace", "default", "Namespace of the leader election lease")
+	flag.IntVar(&config.leaseDuration, "leaseDuration", 15, "Duration followers wait before taking over the lease, in seconds")
+	flag.IntVar(&config.renewDeadline, "renewDeadline", 10, "Duration the leader retries renewing the lease before giving up, in seconds")
+	flag.IntVar(&config.retryPeriod, "retryPeriod", 2, "Period between lease acquire or renew attempts, in seconds")
 	flag.BoolVar(&config.debug, "debug", false, "Enable debug messages")
 
 	log.Formatter = new(logrus.TextFormatter)
@@ -215,30 +507,145 @@ func main() {
 		log.SetLevel(logrus.DebugLevel)
 	}
 
-	client, err := loadClient(config.kubeConfig)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+	if config.listenAddress != "" {
+		go serveHTTP(config.listenAddress)
 	}
 
-	log.Infof("Initial GetServices fired")
-	currentServices, err := getServices(client, config.filterType)
+	if config.endpointsAPI != "endpointslices" && config.endpointsAPI != "endpoints" {
+		log.Fatalf("Unknown endpoints API: %v", config.endpointsAPI)
+	}
+
+	backend, err := newBackend(config.backend)
 	if err != nil {
-		log.Fatalf("Failed initial GetServices: %v", err)
+		log.Fatalf("Failed to create backend: %v", err)
 	}
-	configureServices(currentServices, config.tmplFile, config.configFile)
 
-	for t := range time.NewTicker(time.Duration(config.syncPeriod) * time.Second).C {
+	var vips *vipManager
+	if config.vipInterface != "" {
+		vips, err = newVIPManager(config.vipInterface, config.vipStateFile)
+		if err != nil {
+			log.Fatalf("Failed to create VIP manager: %v", err)
+		}
+	}
 
-		log.Debugf("GetServices fired at %+v", t)
-		newServices, err := getServices(client, config.filterType)
+	var speaker *bgpSpeaker
+	if config.bgpASN != 0 {
+		speaker, err = newBGPSpeaker(context.Background())
 		if err != nil {
-			log.Errorf("Failed GetServices: %v", err)
+			log.Fatalf("Failed to create BGP speaker: %v", err)
 		}
+	}
 
-		if !reflect.DeepEqual(newServices, currentServices) {
-			log.Infof("Services have changed, reload fired")
+	clusterConfigs := []clusterConfig{{
+		KubeConfig: config.kubeConfig,
+		Context:    config.kubeContext,
+		FilterType: config.filterType,
+		IPPools:    config.ipPools,
+	}}
+
+	if config.clustersFile != "" {
+		clusterConfigs, err = loadClusters(config.clustersFile)
+		if err != nil {
+			log.Fatalf("Failed to load clusters: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	changed := make(chan struct{}, 1)
+
+	var clusters []*cluster
+	for _, cfg := range clusterConfigs {
+		c, err := newCluster(ctx, cfg, changed)
+		if err != nil {
+			log.Fatalf("Cluster %v: %v", cfg.Name, err)
+		}
+		clusters = append(clusters, c)
+	}
+	if config.clustersFile != "" {
+		log.Infof("Watching clusters: %v", clusterNames(clusters))
+	}
+
+	// only the leader writes to the cluster, every replica renders its config
+	log.Infof("Initial GetServices fired")
+	allocateAddresses(ctx, clusters)
+
+	currentServices := getAllServices(clusters)
+
+	// the addresses must be up before the proxy binds them
+	if vips != nil {
+		vips.sync(currentServices)
+	}
+	if speaker != nil {
+		speaker.sync(ctx, currentServices)
+	}
+
+	applied := applyServices(ctx, backend, clusters, currentServices)
+	if applied {
+		lastSyncTimestamp.SetToCurrentTime()
+		state.synced(currentServices)
+		updateStatus(ctx, clusters, currentServices)
+	}
+
+	templatesChanged := make(chan struct{}, 1)
+	if config.templatesDir != "" {
+		go watchTemplates(config.templatesDir, templatesChanged)
+	}
+
+	ticker := time.NewTicker(time.Duration(config.syncPeriod) * time.Second)
+
+	for {
+		// a round is only a successful sync if every cluster could be resynced
+		resynced := true
+		// the services may be unchanged, the configs they render to are not
+		rerender := false
+
+		select {
+		case <-changed:
+			log.Debugf("Cache changed, GetServices fired")
+		case <-templatesChanged:
+			log.Infof("Templates have changed, GetServices fired")
+			rerender = true
+		case t := <-ticker.C:
+			log.Debugf("Resync fired at %+v", t)
+			for _, c := range clusters {
+				err := c.cache.resync(ctx)
+				if err != nil {
+					getServicesErrors.Inc()
+					log.Errorf("Failed resync of cluster %v: %v", c.name, err)
+					resynced = false
+				}
+			}
+		}
+
+		allocateAddresses(ctx, clusters)
+
+		newServices := getAllServices(clusters)
+
+		if vips != nil {
+			vips.sync(newServices)
+		}
+		if speaker != nil {
+			speaker.sync(ctx, newServices)
+		}
+
+		// a failed apply is retried on every round until it succeeds
+		if !applied || rerender || !reflect.DeepEqual(newServices, currentServices) {
+			switch {
+			case !applied:
+				log.Infof("Last apply failed, retrying")
+			case rerender:
+				log.Infof("Rendering the services again with the new templates")
+			default:
+				log.Infof("Services have changed, reload fired")
+			}
 			currentServices = newServices
-			configureServices(currentServices, config.tmplFile, config.configFile)
+			applied = applyServices(ctx, backend, clusters, currentServices)
+		}
+
+		if applied && resynced {
+			lastSyncTimestamp.SetToCurrentTime()
+			state.synced(currentServices)
+			updateStatus(ctx, clusters, currentServices)
 		}
 	}
 }
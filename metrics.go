@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+var (
+	getServicesDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "extlb_get_services_duration_seconds",
+		Help: "Duration of GetServices runs.",
+	})
+	getServicesErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "extlb_get_services_errors_total",
+		Help: "Errors while fetching services and endpoints from the api-server.",
+	})
+	servicesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "extlb_services",
+		Help: "Number of services served, by namespace.",
+	}, []string{"namespace"})
+	endpointsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "extlb_endpoints",
+		Help: "Number of endpoints served, by namespace.",
+	}, []string{"namespace"})
+	renderFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "extlb_template_render_failures_total",
+		Help: "Template load or render failures.",
+	})
+	reloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "extlb_reloads_total",
+		Help: "Proxy reloads, by result.",
+	}, []string{"result"})
+	reloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "extlb_reload_duration_seconds",
+		Help: "Duration of proxy reloads.",
+	})
+	lastSyncTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "extlb_last_successful_sync_timestamp_seconds",
+		Help: "Timestamp of the last successful sync.",
+	})
+	configInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "extlb_config_info",
+		Help: "Hash of the config files currently applied.",
+	}, []string{"file", "sha256"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		getServicesDuration,
+		getServicesErrors,
+		servicesGauge,
+		endpointsGauge,
+		renderFailures,
+		reloadsTotal,
+		reloadDuration,
+		lastSyncTimestamp,
+		configInfo,
+	)
+}
+
+func recordServices(services []Service, start time.Time) {
+
+	getServicesDuration.Observe(time.Since(start).Seconds())
+
+	servicesGauge.Reset()
+	endpointsGauge.Reset()
+	for _, service := range services {
+		servicesGauge.WithLabelValues(service.Namespace).Inc()
+		endpointsGauge.WithLabelValues(service.Namespace).Add(float64(len(service.Backends)))
+	}
+}
+
+func recordReload(err error, start time.Time) {
+
+	reloadDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		reloadsTotal.WithLabelValues("failure").Inc()
+	} else {
+		reloadsTotal.WithLabelValues("success").Inc()
+	}
+}
+
+// last hash recorded per config, to drop its previous series
+var (
+	configHashesMu sync.Mutex
+	configHashes   = make(map[string]string)
+)
+
+func recordConfig(configFile string) {
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Warnf("Cannot hash config file: %v", err)
+		return
+	}
+
+	recordConfigData(configFile, data)
+}
+
+// recordConfigData is recordConfig for configs not backed by a file
+func recordConfigData(name string, data []byte) {
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	configHashesMu.Lock()
+	defer configHashesMu.Unlock()
+
+	if prev, ok := configHashes[name]; ok && prev != hash {
+		configInfo.DeleteLabelValues(name, prev)
+	}
+	configHashes[name] = hash
+	configInfo.WithLabelValues(name, hash).Set(1)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// outputConfig is an entry of the -outputsFile file
+type outputConfig struct {
+	Name        string       `json:"name"`
+	Template    string       `json:"template"`
+	Destination string       `json:"destination"`
+	Reload      string       `json:"reload"`
+	Check       string       `json:"check"`
+	Filter      outputFilter `json:"filter"`
+}
+
+// outputFilter selects the services rendered into an output, empty fields
+// match everything. Annotation is "key" or "key=value", on the extlb/
+// annotations with the prefix stripped.
+type outputFilter struct {
+	LBType     string `json:"lbType"`
+	Namespace  string `json:"namespace"`
+	Annotation string `json:"annotation"`
+}
+
+func (f outputFilter) match(s Service) bool {
+
+	if f.LBType != "" && s.Labels["lb_type"] != f.LBType {
+		return false
+	}
+	if f.Namespace != "" && s.Namespace != f.Namespace {
+		return false
+	}
+
+	if f.Annotation != "" {
+		parts := strings.SplitN(f.Annotation, "=", 2)
+		v, ok := s.Annotations[parts[0]]
+		if !ok || (len(parts) == 2 && v != parts[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f outputFilter) apply(services []Service) []Service {
+
+	if f == (outputFilter{}) {
+		return services
+	}
+
+	selected := []Service{}
+	for _, s := range services {
+		if f.match(s) {
+			selected = append(selected, s)
+		}
+	}
+
+	return selected
+}
+
+func loadOutputs(path string) ([]*templateOutput, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read outputs file: %v", err)
+	}
+
+	var configs []outputConfig
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("unmarshal outputs file: %v", err)
+	}
+
+	var outputs []*templateOutput
+
+	for _, c := range configs {
+		if c.Template == "" || c.Destination == "" || strings.TrimSpace(c.Reload) == "" {
+			return nil, fmt.Errorf("output %v needs a template, a destination and a reload command", c.Name)
+		}
+
+		o := newTemplateOutput(c.Template, c.Destination, c.Reload, c.Check)
+		o.filter = c.Filter
+		outputs = append(outputs, o)
+	}
+
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no output declared in %v", path)
+	}
+
+	return outputs, nil
+}
+
+// checkDestinations fails when two outputs write the same file, which would
+// overwrite each other on every sync
+func checkDestinations(outputs []*templateOutput) error {
+
+	destinations := make(map[string]bool)
+
+	for _, o := range outputs {
+		path := filepath.Clean(o.configFile)
+		if destinations[path] {
+			return fmt.Errorf("destination %v used by several outputs", o.configFile)
+		}
+		destinations[path] = true
+	}
+
+	return nil
+}
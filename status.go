@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+type serviceRef struct {
+	namespace string
+	name      string
+}
+
+// statusWriter publishes the LoadBalancerIP we serve in the Service
+// status.loadBalancer.ingress, and clears it once we stop serving it.
+// Only Services published by this process, or whose ingress is their own
+// LoadBalancerIP (published before a restart or by a previous leader), are
+// ever cleared.
+type statusWriter struct {
+	client    *k8s.Client
+	cache     *serviceCache
+	published map[serviceRef]string
+}
+
+func newStatusWriter(client *k8s.Client, cache *serviceCache) *statusWriter {
+	return &statusWriter{
+		client:    client,
+		cache:     cache,
+		published: make(map[serviceRef]string),
+	}
+}
+
+func patchServiceStatus(ctx context.Context, client *k8s.Client, ref serviceRef, ip string) error {
+
+	var ingress interface{}
+	if ip != "" {
+		ingress = []map[string]string{{"ip": ip}}
+	}
+
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"loadBalancer": map[string]interface{}{
+				"ingress": ingress,
+			},
+		},
+	}
+
+	path := fmt.Sprintf("/api/v1/namespaces/%v/services/%v/status", ref.namespace, ref.name)
+	return apiRequest(ctx, client, "PATCH", path, mergePatchType, patch, nil)
+}
+
+// hasIngress tells if the cached Service status already holds exactly ip
+func hasIngress(s *corev1.Service, ip string) bool {
+	ingress := s.GetStatus().GetLoadBalancer().GetIngress()
+	return len(ingress) == 1 && ingress[0].GetIp() == ip
+}
+
+func (w *statusWriter) update(ctx context.Context, services []Service) {
+
+	want := make(map[serviceRef]string)
+	for _, service := range services {
+		want[serviceRef{service.Namespace, service.ServiceName}] = service.LoadBalancerIP
+	}
+
+	for ref, ip := range want {
+		if s, ok := w.cache.getService(ref.namespace, ref.name); ok && hasIngress(s, ip) {
+			w.published[ref] = ip
+			continue
+		}
+
+		err := patchServiceStatus(ctx, w.client, ref, ip)
+		if err != nil {
+			log.Errorf("Failed to update status of service %v/%v: %v", ref.namespace, ref.name, err)
+			continue
+		}
+
+		log.Infof("Status of service %v/%v updated with ingress %v", ref.namespace, ref.name, ip)
+		w.published[ref] = ip
+	}
+
+	stale := make(map[serviceRef]bool)
+	for ref := range w.published {
+		stale[ref] = true
+	}
+	for _, s := range w.cache.listServices() {
+		ref := serviceRef{s.GetMetadata().GetNamespace(), s.GetMetadata().GetName()}
+		if ip := serviceLoadBalancerIP(s); ip != "" && hasIngress(s, ip) {
+			stale[ref] = true
+		}
+	}
+
+	for ref := range stale {
+		if _, ok := want[ref]; ok {
+			continue
+		}
+
+		err := patchServiceStatus(ctx, w.client, ref, "")
+		if err != nil && !isNotFound(err) {
+			log.Errorf("Failed to clear status of service %v/%v: %v", ref.namespace, ref.name, err)
+			continue
+		}
+
+		log.Infof("Status of service %v/%v cleared", ref.namespace, ref.name)
+		delete(w.published, ref)
+	}
+}
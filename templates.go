@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// templatesPollPeriod is how often -templatesDir is checked for changes
+const templatesPollPeriod = 5
+
+// templateSet holds the sub-templates of -templatesDir, one per *.tmpl file
+// named after the file without extension. They are parsed again whenever a
+// file is added, removed or modified.
+type templateSet struct {
+	sync.Mutex
+	stamp string
+	tmpl  *template.Template
+}
+
+var subTemplates templateSet
+
+// dirStamp summarizes the names, sizes and modification times of the *.tmpl
+// files of dir
+func dirStamp(dir string) (string, []string, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var stamp strings.Builder
+	var names []string
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".tmpl" {
+			continue
+		}
+		fmt.Fprintf(&stamp, "%v:%v:%v;", f.Name(), f.Size(), f.ModTime().UnixNano())
+		names = append(names, f.Name())
+	}
+
+	return stamp.String(), names, nil
+}
+
+// load returns the sub-templates of dir, parsing them again if they changed
+// since the last call, and the stamp of the files they were parsed from
+func (s *templateSet) load(dir string) (*template.Template, string, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if dir == "" {
+		return nil, "", nil
+	}
+
+	stamp, names, err := dirStamp(dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("Cannot read templates dir: %v", err)
+	}
+	if s.tmpl != nil && stamp == s.stamp {
+		return s.tmpl, stamp, nil
+	}
+
+	set := template.New("").Funcs(templateFuncs)
+	set.Funcs(template.FuncMap{"include": includeFunc(set)})
+
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = set.New(strings.TrimSuffix(name, ".tmpl")).Parse(string(data))
+		if err != nil {
+			return nil, "", fmt.Errorf("Cannot parse template %v: %v", name, err)
+		}
+	}
+
+	log.Infof("Loaded %v templates from %v", len(names), dir)
+	s.stamp, s.tmpl = stamp, set
+
+	return set, stamp, nil
+}
+
+// check tells why name cannot be included, or returns nil if it can
+func (s *templateSet) check(dir string, name string) error {
+
+	if dir == "" {
+		return fmt.Errorf("no -templatesDir set")
+	}
+
+	set, _, err := s.load(dir)
+	if err != nil {
+		return err
+	}
+	if set.Lookup(name) == nil {
+		return fmt.Errorf("no template %q in %v", name, dir)
+	}
+
+	return nil
+}
+
+// watchTemplates signals on changed when the templates of dir change, so
+// that the services are evaluated and rendered again
+func watchTemplates(dir string, changed chan struct{}) {
+
+	_, last, _ := subTemplates.load(dir)
+
+	for range time.NewTicker(templatesPollPeriod * time.Second).C {
+		_, stamp, err := subTemplates.load(dir)
+		if err != nil {
+			log.Errorf("Failed to load templates: %v", err)
+			continue
+		}
+		if stamp == last {
+			continue
+		}
+		last = stamp
+
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// includeFunc returns the include template function, executing a template of
+// set by name and returning its output: {{ include $svc.Options.Template $svc }}
+func includeFunc(set *template.Template) func(string, interface{}) (string, error) {
+	return func(name string, data interface{}) (string, error) {
+
+		if set == nil || set.Lookup(name) == nil {
+			return "", fmt.Errorf("no template %q in templates dir", name)
+		}
+
+		var buf bytes.Buffer
+		err := set.ExecuteTemplate(&buf, name, data)
+
+		return buf.String(), err
+	}
+}
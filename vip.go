@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// vipManager keeps the LoadBalancerIPs of the services on a local interface,
+// and announces them on the link when they are added. The addresses it adds
+// are tagged on the interface with the "<iface>:extlb" label for IPv4. IPv6
+// addresses have no label and no flag extlb alone would set, so they are
+// listed in stateFile instead. Only the addresses tagged or listed are ever
+// removed, even those added before a restart, so addresses configured by
+// hand are kept.
+type vipManager struct {
+	link      netlink.Link
+	label     string
+	stateFile string
+	owned     map[string]bool
+}
+
+func newVIPManager(iface string, stateFile string) (*vipManager, error) {
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find interface %v: %v", iface, err)
+	}
+
+	// labels are limited to 15 characters and must start with the name
+	label := iface + ":extlb"
+	if len(label) > 15 {
+		return nil, fmt.Errorf("interface name %v too long to label addresses", iface)
+	}
+
+	m := &vipManager{link: link, label: label, stateFile: stateFile, owned: make(map[string]bool)}
+	if err := m.loadOwned(); err != nil {
+		return nil, fmt.Errorf("Cannot read VIP state file %v: %v", stateFile, err)
+	}
+
+	return m, nil
+}
+
+// loadOwned reads the IPv6 addresses added by a previous run, one per line
+func (m *vipManager) loadOwned() error {
+
+	data, err := ioutil.ReadFile(m.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Fields(string(data)) {
+		if ip := net.ParseIP(line); ip != nil {
+			m.owned[ip.String()] = true
+		}
+	}
+
+	return nil
+}
+
+// saveOwned writes the IPv6 addresses added by extlb, replacing the file
+// at once so that a crash never leaves it half written
+func (m *vipManager) saveOwned() error {
+
+	var lines []string
+	for ip := range m.owned {
+		lines = append(lines, ip+"\n")
+	}
+	sort.Strings(lines)
+
+	tmpFile := m.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, m.stateFile)
+}
+
+// hostAddr returns ip as a tagged /32 or /128 netlink address
+func (m *vipManager) hostAddr(ip net.IP) *netlink.Addr {
+
+	if v4 := ip.To4(); v4 != nil {
+		return &netlink.Addr{IPNet: &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, Label: m.label}
+	}
+
+	// usable at once, without duplicate address detection
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, Flags: unix.IFA_F_NODAD}
+}
+
+// managed tells if the address was added by extlb
+func (m *vipManager) managed(a netlink.Addr) bool {
+
+	if a.IP.To4() != nil {
+		return a.Label == m.label
+	}
+
+	return m.owned[a.IP.String()]
+}
+
+// sync adds the missing addresses of the services to the interface and
+// removes the managed ones no longer used
+func (m *vipManager) sync(services []Service) {
+
+	desired := make(map[string]net.IP)
+	for _, s := range services {
+		if ip := net.ParseIP(s.LoadBalancerIP); ip != nil {
+			desired[ip.String()] = ip
+		}
+	}
+
+	addrs, err := netlink.AddrList(m.link, netlink.FAMILY_ALL)
+	if err != nil {
+		log.Errorf("Cannot list addresses of %v: %v", m.link.Attrs().Name, err)
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, a := range addrs {
+		present[a.IP.String()] = true
+	}
+
+	// forget the addresses removed by hand meanwhile
+	dirty := false
+	for key := range m.owned {
+		if !present[key] {
+			delete(m.owned, key)
+			dirty = true
+		}
+	}
+
+	for key, ip := range desired {
+		if present[key] {
+			continue
+		}
+
+		log.Infof("Adding VIP %v on %v", key, m.link.Attrs().Name)
+		if err := netlink.AddrAdd(m.link, m.hostAddr(ip)); err != nil {
+			log.Errorf("Failed to add VIP %v: %v", key, err)
+			continue
+		}
+		if ip.To4() == nil {
+			m.owned[key] = true
+			dirty = true
+		}
+
+		if err := m.announce(ip); err != nil {
+			log.Warnf("Failed to announce VIP %v: %v", key, err)
+		}
+	}
+
+	for _, a := range addrs {
+		if _, ok := desired[a.IP.String()]; ok || !m.managed(a) {
+			continue
+		}
+
+		log.Infof("Removing VIP %v from %v", a.IP, m.link.Attrs().Name)
+		if err := netlink.AddrDel(m.link, &a); err != nil {
+			log.Errorf("Failed to remove VIP %v: %v", a.IP, err)
+			continue
+		}
+		if m.owned[a.IP.String()] {
+			delete(m.owned, a.IP.String())
+			dirty = true
+		}
+	}
+
+	if dirty {
+		if err := m.saveOwned(); err != nil {
+			log.Errorf("Failed to write VIP state file %v: %v", m.stateFile, err)
+		}
+	}
+}
+
+// announce updates the neighbour caches of the link with a gratuitous ARP
+// for IPv4 or an unsolicited neighbour advertisement for IPv6
+func (m *vipManager) announce(ip net.IP) error {
+
+	if ip.To4() != nil {
+		return m.gratuitousARP(ip.To4())
+	}
+
+	return m.unsolicitedNA(ip)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func (m *vipManager) gratuitousARP(ip net.IP) error {
+
+	attrs := m.link.Attrs()
+	if len(attrs.HardwareAddr) != 6 {
+		return fmt.Errorf("no ethernet address on %v", attrs.Name)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	// ethernet header, then an ARP request for ip from ip
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, attrs.HardwareAddr...)
+	frame = append(frame, 0x08, 0x06) // ARP
+	frame = append(frame, 0x00, 0x01) // ethernet
+	frame = append(frame, 0x08, 0x00) // IPv4
+	frame = append(frame, 6, 4)
+	frame = append(frame, 0x00, 0x01) // request
+	frame = append(frame, attrs.HardwareAddr...)
+	frame = append(frame, ip...)
+	frame = append(frame, broadcast...)
+	frame = append(frame, ip...)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  attrs.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcast)
+
+	return syscall.Sendto(fd, frame, 0, addr)
+}
+
+func (m *vipManager) unsolicitedNA(ip net.IP) error {
+
+	attrs := m.link.Attrs()
+
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	p := c.IPv6PacketConn()
+	ifi := &net.Interface{Index: attrs.Index, Name: attrs.Name}
+	if err := p.SetMulticastInterface(ifi); err != nil {
+		return err
+	}
+	// mandatory for neighbour discovery
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+
+	// override flag, target, then the target link-layer address option
+	body := make([]byte, 4, 28)
+	body[0] = 0x20
+	body = append(body, ip.To16()...)
+	if len(attrs.HardwareAddr) == 6 {
+		body = append(body, 2, 1)
+		body = append(body, attrs.HardwareAddr...)
+	}
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborAdvertisement,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// the kernel computes the checksum of ICMPv6 raw sockets
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.WriteTo(b, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: attrs.Name})
+	return err
+}
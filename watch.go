@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minWatchBackoff = 1 * time.Second
+	maxWatchBackoff = 60 * time.Second
+)
+
+// serviceCache keeps a local copy of Services and their Endpoints (or
+// EndpointSlices, grouped by Service), fed by api-server watch streams.
+// Every change is signaled on the changed channel, which should be buffered.
+type serviceCache struct {
+	sync.RWMutex
+	client    *k8s.Client
+	filter    string
+	useSlices bool
+	svcs      map[string]*corev1.Service
+	eps       map[string]*corev1.Endpoints
+	slices    map[string]map[string]*endpointSlice
+	changed   chan struct{}
+}
+
+func cacheKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+func newServiceCache(client *k8s.Client, filter string, useSlices bool, changed chan struct{}) *serviceCache {
+	return &serviceCache{
+		client:    client,
+		filter:    filter,
+		useSlices: useSlices,
+		svcs:      make(map[string]*corev1.Service),
+		eps:       make(map[string]*corev1.Endpoints),
+		slices:    make(map[string]map[string]*endpointSlice),
+		changed:   changed,
+	}
+}
+
+// notify signals a change without blocking, pending signals are coalesced
+func (c *serviceCache) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *serviceCache) selector() k8s.Option {
+	ls := new(k8s.LabelSelector)
+	if c.filter != "" {
+		ls.Eq("lb_type", c.filter)
+	}
+	return ls.Selector()
+}
+
+func (c *serviceCache) loadServices(ctx context.Context) (string, error) {
+
+	var svcs corev1.ServiceList
+	err := c.client.List(ctx, k8s.AllNamespaces, &svcs, c.selector())
+	if err != nil {
+		return "", fmt.Errorf("Cannot list services: %v", err)
+	}
+
+	m := make(map[string]*corev1.Service, len(svcs.Items))
+	for _, s := range svcs.Items {
+		m[cacheKey(s.GetMetadata().GetNamespace(), s.GetMetadata().GetName())] = s
+	}
+
+	c.Lock()
+	c.svcs = m
+	c.Unlock()
+	c.notify()
+
+	return svcs.GetMetadata().GetResourceVersion(), nil
+}
+
+func (c *serviceCache) loadEndpoints(ctx context.Context) (string, error) {
+
+	var eps corev1.EndpointsList
+	err := c.client.List(ctx, k8s.AllNamespaces, &eps)
+	if err != nil {
+		return "", fmt.Errorf("Cannot list endpoints: %v", err)
+	}
+
+	m := make(map[string]*corev1.Endpoints, len(eps.Items))
+	for _, ep := range eps.Items {
+		m[cacheKey(ep.GetMetadata().GetNamespace(), ep.GetMetadata().GetName())] = ep
+	}
+
+	c.Lock()
+	c.eps = m
+	c.Unlock()
+	c.notify()
+
+	return eps.GetMetadata().GetResourceVersion(), nil
+}
+
+func (c *serviceCache) watchServices(ctx context.Context, rv string) error {
+
+	w, err := c.client.Watch(ctx, k8s.AllNamespaces, new(corev1.Service), c.selector(), k8s.ResourceVersion(rv))
+	if err != nil {
+		return fmt.Errorf("Cannot watch services: %v", err)
+	}
+	defer w.Close()
+
+	for {
+		s := new(corev1.Service)
+		event, err := w.Next(s)
+		if err != nil {
+			return err
+		}
+
+		key := cacheKey(s.GetMetadata().GetNamespace(), s.GetMetadata().GetName())
+		log.Debugf("Service event %v: %v", event, key)
+
+		c.Lock()
+		switch event {
+		case k8s.EventAdded, k8s.EventModified:
+			c.svcs[key] = s
+		case k8s.EventDeleted:
+			delete(c.svcs, key)
+		}
+		c.Unlock()
+		c.notify()
+	}
+}
+
+func (c *serviceCache) watchEndpoints(ctx context.Context, rv string) error {
+
+	w, err := c.client.Watch(ctx, k8s.AllNamespaces, new(corev1.Endpoints), k8s.ResourceVersion(rv))
+	if err != nil {
+		return fmt.Errorf("Cannot watch endpoints: %v", err)
+	}
+	defer w.Close()
+
+	for {
+		ep := new(corev1.Endpoints)
+		event, err := w.Next(ep)
+		if err != nil {
+			return err
+		}
+
+		key := cacheKey(ep.GetMetadata().GetNamespace(), ep.GetMetadata().GetName())
+		log.Debugf("Endpoints event %v: %v", event, key)
+
+		c.Lock()
+		switch event {
+		case k8s.EventAdded, k8s.EventModified:
+			c.eps[key] = ep
+		case k8s.EventDeleted:
+			delete(c.eps, key)
+		}
+		c.Unlock()
+		c.notify()
+	}
+}
+
+// watchClosed tells if a watch ended normally, the api-server closing the
+// stream once its timeout is reached. The client wraps the decoder error
+// into a string, hence the suffix checks.
+func watchClosed(err error) bool {
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	msg := err.Error()
+	return strings.HasSuffix(msg, io.EOF.Error()) || strings.HasSuffix(msg, "use of closed network connection")
+}
+
+// run keeps a watch alive: when the stream drops, the resource is listed
+// again to get a fresh resource version and the watch is restarted from it
+func (c *serviceCache) run(ctx context.Context, kind string, rv string,
+	load func(context.Context) (string, error), watch func(context.Context, string) error) {
+
+	backoff := minWatchBackoff
+
+	for {
+		err := watch(ctx, rv)
+		if ctx.Err() != nil {
+			return
+		}
+		if watchClosed(err) {
+			log.Debugf("Watch on %v closed: %v", kind, err)
+		} else {
+			getServicesErrors.Inc()
+			log.Warnf("Watch on %v dropped: %v", kind, err)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			rv, err = load(ctx)
+			if err == nil {
+				backoff = minWatchBackoff
+				break
+			}
+			getServicesErrors.Inc()
+			log.Errorf("Failed to relist %v: %v", kind, err)
+
+			backoff *= 2
+			if backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+		}
+	}
+}
+
+// start does the initial list of Services and Endpoints, then watches them
+// in background until ctx is cancelled
+func (c *serviceCache) start(ctx context.Context) error {
+
+	svcRV, err := c.loadServices(ctx)
+	if err != nil {
+		return err
+	}
+	go c.run(ctx, "services", svcRV, c.loadServices, c.watchServices)
+
+	if c.useSlices {
+		sliceRV, err := c.loadEndpointSlices(ctx)
+		if err != nil {
+			return err
+		}
+		go c.run(ctx, "endpointslices", sliceRV, c.loadEndpointSlices, c.watchEndpointSlices)
+		return nil
+	}
+
+	epRV, err := c.loadEndpoints(ctx)
+	if err != nil {
+		return err
+	}
+	go c.run(ctx, "endpoints", epRV, c.loadEndpoints, c.watchEndpoints)
+
+	return nil
+}
+
+// resync does a full list of Services and Endpoints, as a fallback in case
+// some watch events were missed
+func (c *serviceCache) resync(ctx context.Context) error {
+
+	if _, err := c.loadServices(ctx); err != nil {
+		return err
+	}
+
+	if c.useSlices {
+		_, err := c.loadEndpointSlices(ctx)
+		return err
+	}
+
+	_, err := c.loadEndpoints(ctx)
+	return err
+}
+
+// listServices returns the cached Services sorted by namespace/name
+func (c *serviceCache) listServices() []*corev1.Service {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	keys := make([]string, 0, len(c.svcs))
+	for k := range c.svcs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	svcs := make([]*corev1.Service, 0, len(keys))
+	for _, k := range keys {
+		svcs = append(svcs, c.svcs[k])
+	}
+
+	return svcs
+}
+
+func (c *serviceCache) getEndpoints(namespace string, name string) (*corev1.Endpoints, bool) {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	ep, ok := c.eps[cacheKey(namespace, name)]
+	return ep, ok
+}
+
+func (c *serviceCache) getService(namespace string, name string) (*corev1.Service, bool) {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	s, ok := c.svcs[cacheKey(namespace, name)]
+	return s, ok
+}